@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/insomniacslk/codesearch/pkg/codesearch"
+)
+
+// formatter writes the results of a search in an output format.
+type formatter interface {
+	// Result writes a result, as soon as it is available.
+	Result(res codesearch.Result) error
+	// Close writes what follows the results, e.g. the stats, at the end of
+	// the search.
+	Close(stats *codesearch.Stats) error
+}
+
+// searchInfo describes the search, for the formats that include it.
+type searchInfo struct {
+	// Query is the query, as returned by Query.String.
+	Query string
+	// SavedSearch is the name of the saved search, if the search was run
+	// with "@name".
+	SavedSearch string
+}
+
+// ruleID returns an identifier of the search that stays the same across
+// runs: the name of the saved search, or the query.
+func (i searchInfo) ruleID() string {
+	if i.SavedSearch != "" {
+		return i.SavedSearch
+	}
+	return i.Query
+}
+
+// formats are the output formats of the search command, by name.
+var formats = map[string]func(w io.Writer, info searchInfo) formatter{
+	"text":  newTextFormatter,
+	"json":  newJSONFormatter,
+	"jsonl": newJSONLFormatter,
+	"csv":   newCSVFormatter,
+	"grep":  newGrepFormatter,
+	"sarif": newSARIFFormatter,
+	"html":  newHTMLFormatter,
+}
+
+// formatNames returns the names of the output formats, sorted.
+func formatNames() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newFormatter returns the formatter with the given name, writing to w.
+func newFormatter(name string, w io.Writer, info searchInfo) (formatter, error) {
+	newFormatter, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q, possible values: %s", name, strings.Join(formatNames(), ", "))
+	}
+	return newFormatter(w, info), nil
+}
+
+// textFormatter writes the results in human-readable form, with colors and
+// hyperlinks. The stats are printed on stderr by the search command.
+type textFormatter struct {
+	w io.Writer
+}
+
+func newTextFormatter(w io.Writer, info searchInfo) formatter {
+	return &textFormatter{w: w}
+}
+
+func (f *textFormatter) Result(res codesearch.Result) error {
+	return printResult(f.w, res)
+}
+
+func (f *textFormatter) Close(stats *codesearch.Stats) error {
+	return nil
+}
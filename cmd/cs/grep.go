@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/codesearch/pkg/codesearch"
+)
+
+// grepFormatter writes one "path:line:col:text" line per matched line, like
+// "grep -n --column" or "rg --vimgrep", which Vim's quickfix list, Emacs'
+// grep-mode and VS Code's problem matchers understand. Local files have their
+// absolute path, remote files their URL. The context lines are not written.
+type grepFormatter struct {
+	w io.Writer
+}
+
+func newGrepFormatter(w io.Writer, info searchInfo) formatter {
+	return &grepFormatter{w: w}
+}
+
+// localPath returns the absolute path of the file of a result, if it is a
+// local file, e.g. from the csearch backend.
+func localPath(res *codesearch.Result) (string, bool) {
+	u, err := url.Parse(res.FileURL)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// grepLocation returns the location of the file of a result in the grep
+// format: the absolute path of local files, or the URL of remote files
+// without the line anchor.
+func grepLocation(res *codesearch.Result) string {
+	if p, ok := localPath(res); ok {
+		return p
+	}
+	u, err := url.Parse(res.FileURL)
+	if err != nil || res.FileURL == "" {
+		return res.Path
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+func (f *grepFormatter) Result(res codesearch.Result) error {
+	location := grepLocation(&res)
+	if res.IsFilename || len(res.Lines) == 0 {
+		_, err := fmt.Fprintf(f.w, "%s:1:1:\n", location)
+		return err
+	}
+	for idx, line := range res.Lines {
+		// the column of the first highlight of the line, or of the start of
+		// the match
+		column := 1
+		if idx == 0 {
+			column = res.Start.Column
+		}
+		if hls := res.LineHighlights(idx); len(hls) > 0 {
+			column = hls[0].Start + 1
+		}
+		if _, err := fmt.Fprintf(f.w, "%s:%d:%d:%s\n", location, res.Start.Line+idx, column, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *grepFormatter) Close(stats *codesearch.Stats) error {
+	return nil
+}
+
+// openInEditor opens the file of a local result at the matched line, with
+// "$EDITOR +line file". EDITOR can have arguments, and defaults to vi.
+func openInEditor(res *codesearch.Result) error {
+	p, ok := localPath(res)
+	if !ok {
+		return fmt.Errorf("not a local file: %s", res.FileURL)
+	}
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	args := append(editor[1:], "+"+strconv.Itoa(max(res.Start.Line, 1)), p)
+	cmd := exec.Command(editor[0], args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run %s: %w", editor[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/codesearch/pkg/codesearch"
+)
+
+//go:embed report.html.tmpl
+var reportTemplateText string
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"safeURL":       safeURL,
+	"languageStats": languageStats,
+	"round":         func(d time.Duration) time.Duration { return d.Round(time.Millisecond) },
+}).Parse(reportTemplateText))
+
+// htmlReport is the data of the HTML report: the results grouped by
+// backend, repository and file, in the order in which they were found.
+type htmlReport struct {
+	Query       string
+	SavedSearch string
+	Generated   time.Time
+	Stats       *codesearch.Stats
+	Backends    []*htmlBackend
+	Repos       []string
+}
+
+type htmlBackend struct {
+	Name  string
+	Repos []*htmlRepo
+}
+
+type htmlRepo struct {
+	Name  string
+	URL   string
+	Files []*htmlFile
+}
+
+type htmlFile struct {
+	Path     string
+	URL      string
+	Language string
+	Results  []htmlResult
+}
+
+type htmlResult struct {
+	URL        string
+	IsFilename bool
+	SymbolKind string
+	Lines      []htmlLine
+}
+
+// htmlLine is a line of a result, either matched or context, split in
+// segments that are highlighted or not.
+type htmlLine struct {
+	Number   int
+	Context  bool
+	Segments []lineSegment
+}
+
+// htmlFormatter writes a self-contained HTML report once the search is
+// complete. The syntax highlighting and the filters are done client-side by
+// the script embedded in the report.
+type htmlFormatter struct {
+	w      io.Writer
+	report htmlReport
+	// indexes of the groups by name, to append to them
+	backends map[string]*htmlBackend
+	repos    map[string]*htmlRepo
+	files    map[string]*htmlFile
+}
+
+func newHTMLFormatter(w io.Writer, info searchInfo) formatter {
+	return &htmlFormatter{
+		w: w,
+		report: htmlReport{
+			Query:       info.Query,
+			SavedSearch: info.SavedSearch,
+		},
+		backends: make(map[string]*htmlBackend),
+		repos:    make(map[string]*htmlRepo),
+		files:    make(map[string]*htmlFile),
+	}
+}
+
+// safeURL marks the URLs with a known scheme as safe to use in links, so that
+// html/template doesn't filter out the file:// URLs of local results.
+func safeURL(s string) template.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	switch u.Scheme {
+	case "http", "https", "file":
+		return template.URL(u.String())
+	default:
+		return ""
+	}
+}
+
+func (f *htmlFormatter) Result(res codesearch.Result) error {
+	backend, ok := f.backends[res.Backend]
+	if !ok {
+		backend = &htmlBackend{Name: res.Backend}
+		f.backends[res.Backend] = backend
+		f.report.Backends = append(f.report.Backends, backend)
+	}
+	repoName := repoNameFromRes(&res)
+	repoKey := res.Backend + "\x00" + repoName
+	repo, ok := f.repos[repoKey]
+	if !ok {
+		repo = &htmlRepo{Name: repoName, URL: res.RepoURL}
+		f.repos[repoKey] = repo
+		backend.Repos = append(backend.Repos, repo)
+	}
+	fileKey := repoKey + "\x00" + res.Path
+	file, ok := f.files[fileKey]
+	if !ok {
+		// the file URL without the line anchor of this result
+		fileURL := res.FileURL
+		if u, err := url.Parse(res.FileURL); err == nil {
+			u.Fragment = ""
+			fileURL = u.String()
+		}
+		file = &htmlFile{Path: res.Path, URL: fileURL, Language: res.Language}
+		f.files[fileKey] = file
+		repo.Files = append(repo.Files, file)
+	}
+	hres := htmlResult{URL: res.FileURL, IsFilename: res.IsFilename, SymbolKind: string(res.SymbolKind)}
+	if !res.IsFilename {
+		first := res.Start.Line - len(res.Context.Before)
+		for idx, line := range res.Context.Before {
+			hres.Lines = append(hres.Lines, htmlLine{Number: first + idx, Context: true, Segments: splitRanges(line, nil)})
+		}
+		for idx, line := range res.Lines {
+			hres.Lines = append(hres.Lines, htmlLine{Number: res.Start.Line + idx, Segments: splitRanges(line, res.LineHighlights(idx))})
+		}
+		for idx, line := range res.Context.After {
+			hres.Lines = append(hres.Lines, htmlLine{Number: res.End.Line + idx + 1, Context: true, Segments: splitRanges(line, nil)})
+		}
+	}
+	file.Results = append(file.Results, hres)
+	return nil
+}
+
+func (f *htmlFormatter) Close(stats *codesearch.Stats) error {
+	f.report.Generated = time.Now()
+	f.report.Stats = stats
+	// sort the backends like the stats, which follow the order of the
+	// request
+	order := make(map[string]int, len(stats.Backends))
+	for idx, bs := range stats.Backends {
+		order[bs.Backend] = idx
+	}
+	sort.SliceStable(f.report.Backends, func(i, j int) bool {
+		return order[f.report.Backends[i].Name] < order[f.report.Backends[j].Name]
+	})
+	seen := make(map[string]struct{})
+	for _, backend := range f.report.Backends {
+		for _, repo := range backend.Repos {
+			if _, ok := seen[repo.Name]; !ok {
+				seen[repo.Name] = struct{}{}
+				f.report.Repos = append(f.report.Repos, repo.Name)
+			}
+		}
+	}
+	sort.Strings(f.report.Repos)
+	if err := reportTemplate.Execute(f.w, f.report); err != nil {
+		return fmt.Errorf("failed to write HTML report: %w", err)
+	}
+	return nil
+}
+
+// Title returns the title of the report.
+func (r htmlReport) Title() string {
+	if r.SavedSearch != "" {
+		return fmt.Sprintf("%s: @%s", progname, r.SavedSearch)
+	}
+	return fmt.Sprintf("%s: %s", progname, strings.TrimSpace(r.Query))
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
 	"sort"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/fatih/color"
@@ -19,6 +26,14 @@ import (
 
 const progname = "cs"
 
+// exit codes of the search command, besides 0 for success
+const (
+	// no backend returned any result
+	exitNoResults = 1
+	// at least one backend failed, the results of the others are printed
+	exitBackendsFailed = 2
+)
+
 //go:embed config.yml.example
 var configFileExample string
 
@@ -33,8 +48,23 @@ var (
 	flagSearchContextBefore int
 	flagSearchContextAfter  int
 	flagCaseInsensitive     bool
+	flagScope               string
+	flagRegex               bool
+	flagFixedStrings        bool
+	flagWordRegexp          bool
+	flagSymbol              bool
+	flagSmartCase           bool
+	flagInclude             []string
+	flagLangs               []string
+	flagExclude             []string
 	flagLimit               uint
 	flagSort                string
+	flagTimeout             time.Duration
+	flagFormat              string
+	flagOpen                int
+	flagTemplate            string
+	flagTemplateFile        string
+	flagOutput              string
 
 	searchBackends string
 
@@ -54,18 +84,46 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&flagDebug, "debug", "d", false, "Print debug messages")
 	rootCmd.PersistentFlags().BoolVarP(&flagStats, "stats", "S", false, "Print stats")
 
-	searchCmd.PersistentFlags().StringVarP(&searchBackends, "backends", "b", "", "Comma-separated list of names of the backends to use. The names are defined in your configuration file. If specified, it overrides `default_backends` in the configuration file. \"all\" will use every backend")
-	searchCmd.PersistentFlags().BoolVarP(&flagSearchInFilenames, "search-in-filenames", "F", false, "Search only in file names")
-	searchCmd.PersistentFlags().StringVarP(&flagMatchFilename, "match-filename", "f", "", "Show results only from files whose names match the provided pattern")
-	searchCmd.PersistentFlags().IntVarP(&flagSearchContextBefore, "before", "B", 0, "Number of context lines to show before the result")
-	searchCmd.PersistentFlags().IntVarP(&flagSearchContextAfter, "after", "A", 0, "Number of context lines to show after the result")
-	searchCmd.PersistentFlags().BoolVarP(&flagCaseInsensitive, "case-insensitive", "i", false, "Case-insensitive search")
-	searchCmd.PersistentFlags().UintVarP(&flagLimit, "limit", "l", 0, "Limit the amount of results that are printed per backend. 0 means no limit")
-	searchCmd.PersistentFlags().StringVarP(&flagSort, "sort", "s", "", "Sort the results. Possible values: \"a-z\", \"z-a\"")
+	// explain accepts the same flags as search, to describe the same search
+	for _, cmd := range []*cobra.Command{searchCmd, explainCmd} {
+		flags := cmd.PersistentFlags()
+		flags.StringVarP(&searchBackends, "backends", "b", "", "Comma-separated list of names of the backends to use. The names are defined in your configuration file. If specified, it overrides `default_backends` in the configuration file. \"all\" will use every backend")
+		flags.BoolVar(&flagSearchInFilenames, "search-in-filenames", false, "Search only in file names")
+		flags.StringVarP(&flagMatchFilename, "match-filename", "f", "", "Show results only from files whose names match the provided pattern")
+		flags.StringSliceVar(&flagLangs, "lang", nil, "Comma-separated list of languages of the files to search, like `lang:` in the query, e.g. go,proto")
+		flags.StringArrayVar(&flagInclude, "include", nil, "Only search files whose path matches this glob, e.g. 'src/**/*.go'. Can be repeated, a glob starting with '!' is negated")
+		flags.StringArrayVar(&flagExclude, "exclude", nil, "Do not search files whose path matches this glob, e.g. 'vendor/**'. Can be repeated, a glob starting with '!' is negated, and applies after `default_excludes` in the configuration file")
+		flags.IntVarP(&flagSearchContextBefore, "before", "B", 0, "Number of context lines to show before the result")
+		flags.IntVarP(&flagSearchContextAfter, "after", "A", 0, "Number of context lines to show after the result")
+		flags.BoolVarP(&flagCaseInsensitive, "case-insensitive", "i", false, "Case-insensitive search")
+		flags.BoolVar(&flagSmartCase, "smart-case", false, "Case-insensitive search if the search terms are all lowercase, case-sensitive otherwise")
+		cmd.MarkFlagsMutuallyExclusive("case-insensitive", "smart-case")
+		flags.BoolVarP(&flagRegex, "regex", "e", false, "Interpret the search terms as a regular expression on every backend, like /.../ in the query")
+		flags.BoolVarP(&flagFixedStrings, "fixed-strings", "F", false, "Interpret the search terms as literal text on every backend, like quoted text in the query")
+		cmd.MarkFlagsMutuallyExclusive("regex", "fixed-strings")
+		flags.BoolVarP(&flagWordRegexp, "word-regexp", "w", false, "Only show matches surrounded by word boundaries")
+		flags.BoolVar(&flagSymbol, "symbol", false, "Only show the definitions of the symbols whose name matches the search terms, e.g. functions and types")
+		cmd.MarkFlagsMutuallyExclusive("symbol", "search-in-filenames")
+		flags.StringVar(&flagScope, "scope", "file", "Where the terms of boolean queries must appear. Possible values: \"file\", \"line\"")
+		flags.UintVarP(&flagLimit, "limit", "l", 0, "Limit the amount of results that are printed per backend. 0 means no limit")
+		flags.StringVarP(&flagSort, "sort", "s", "", "Sort the results. Possible values: \"a-z\", \"z-a\"")
+		flags.DurationVarP(&flagTimeout, "timeout", "t", 0, "Maximum duration of the search on each backend. If specified, it overrides the backend's `timeout` in the configuration file. 0 means no timeout")
+	}
+
+	searchCmd.Flags().StringVar(&flagFormat, "format", "text", fmt.Sprintf("Output format. Possible values: %s. See the README for the schema of the machine-readable formats", strings.Join(formatNames(), ", ")))
+	searchCmd.Flags().StringVar(&flagTemplate, "template", "", "Print each result with this Go text/template, or with the template of the configuration file with this name, e.g. '{{.Path}}:{{.Lineno}}'. See the README for the data and the functions available")
+	searchCmd.Flags().StringVar(&flagTemplateFile, "template-file", "", "Print each result with the Go text/template in this file, see --template")
+	searchCmd.MarkFlagsMutuallyExclusive("format", "template", "template-file")
+	searchCmd.Flags().StringVarP(&flagOutput, "output", "o", "", "Write the results to this file instead of the standard output, e.g. with --format html")
+	searchCmd.Flags().IntVar(&flagOpen, "open", 0, "Open the N-th result in a local file with `$EDITOR +line file` after the search, counting from 1. 0 means do not open any file")
 
 	rootCmd.AddCommand(searchCmd)
+	rootCmd.AddCommand(explainCmd)
 	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(capabilitiesCmd)
 	rootCmd.AddCommand(configExampleCmd)
+	savedCmd.AddCommand(savedListCmd)
+	rootCmd.AddCommand(savedCmd)
 }
 
 func initConfig() {
@@ -104,7 +162,7 @@ func initConfig() {
 
 var listCmd = &cobra.Command{
 	Use:   "list",
-	Short: "List the available backends",
+	Short: "List the configured backends and the available backend types",
 	Run: func(cmd *cobra.Command, args []string) {
 		config := getConfig()
 		backendNames := make([]string, 0, len(config.Backends))
@@ -115,38 +173,108 @@ var listCmd = &cobra.Command{
 		for idx, name := range backendNames {
 			fmt.Printf("%d) %s (type=%q)\n", idx+1, name, config.Backends[name].Type)
 		}
+		types := codesearch.BackendTypes()
+		typeNames := make([]string, 0, len(types))
+		for _, t := range types {
+			typeNames = append(typeNames, string(t))
+		}
+		fmt.Printf("\nAvailable backend types: %s\n", strings.Join(typeNames, ", "))
 	},
 }
 
-var configExampleCmd = &cobra.Command{
-	Use:   "config-example",
-	Short: "Print an example config file",
+var savedCmd = &cobra.Command{
+	Use:   "saved",
+	Short: "Manage the saved searches of the configuration file",
+}
+
+var savedListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the saved searches, to run with `search @name`",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println(configFileExample)
+		config := getConfig()
+		names := make([]string, 0, len(config.SavedSearches))
+		for name := range config.SavedSearches {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "NAME\tQUERY\tPARAMETERS\tDESCRIPTION\n")
+		for _, name := range names {
+			saved := config.SavedSearches[name]
+			params := make([]string, 0, len(saved.Parameters()))
+			for _, param := range saved.Parameters() {
+				if value, ok := saved.Params[param]; ok {
+					param += "=" + value
+				}
+				params = append(params, param)
+			}
+			fmt.Fprintf(w, "@%s\t%s\t%s\t%s\n", name, saved.Query, strings.Join(params, " "), saved.Description)
+		}
+		w.Flush()
 	},
 }
 
-type sorter func(codesearch.Results) codesearch.Results
-
-func getSorter(method string) sorter {
-	switch method {
-	case "a-z":
-		return func(r codesearch.Results) codesearch.Results {
-			sort.Slice(r, func(i, j int) bool { return r[i].Path < r[j].Path })
-			return r
+var capabilitiesCmd = &cobra.Command{
+	Use:   "capabilities",
+	Short: "Print the features natively supported by each configured backend",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := getConfig()
+		backendNames := make([]string, 0, len(config.Backends))
+		for name := range config.Backends {
+			backendNames = append(backendNames, name)
 		}
-	case "z-a":
-		return func(r codesearch.Results) codesearch.Results {
-			sort.Slice(r, func(i, j int) bool { return r[i].Path > r[j].Path })
-			return r
+		sort.Strings(backendNames)
+		caps := make([]codesearch.Capabilities, 0, len(backendNames))
+		for _, name := range backendNames {
+			backend, err := codesearch.NewBackend(name, config.Backends[name])
+			if err != nil {
+				logrus.Fatalf("Failed to instantiate backend %q: %v", name, err)
+			}
+			caps = append(caps, backend.Capabilities())
 		}
-	case "":
-		return func(r codesearch.Results) codesearch.Results {
-			return r
+		yesNo := func(v bool) string {
+			if v {
+				return "yes"
+			}
+			return "no"
 		}
-	default:
-		return nil
-	}
+		rows := []struct {
+			feature string
+			value   func(c codesearch.Capabilities) string
+		}{
+			{"Regexp search", func(c codesearch.Capabilities) string { return yesNo(c.Regexp) }},
+			{"Case-sensitive search", func(c codesearch.Capabilities) string { return yesNo(c.CaseSensitive) }},
+			{"Case-insensitive search", func(c codesearch.Capabilities) string { return yesNo(c.CaseInsensitive) }},
+			{"Whole-word search", func(c codesearch.Capabilities) string { return yesNo(c.WordRegexp) }},
+			{"Search in file names", func(c codesearch.Capabilities) string { return yesNo(c.SearchInFilenames) }},
+			{"Boolean queries", func(c codesearch.Capabilities) string { return yesNo(c.Boolean) }},
+			{"Symbol search", func(c codesearch.Capabilities) string { return yesNo(c.Symbols) }},
+			{"Context lines", func(c codesearch.Capabilities) string {
+				if c.MaxContextLines == codesearch.UnlimitedContextLines {
+					return "unlimited"
+				}
+				return fmt.Sprintf("max %d", c.MaxContextLines)
+			}},
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "\t%s\n", strings.Join(backendNames, "\t"))
+		for _, row := range rows {
+			values := make([]string, 0, len(caps))
+			for _, c := range caps {
+				values = append(values, row.value(c))
+			}
+			fmt.Fprintf(w, "%s\t%s\n", row.feature, strings.Join(values, "\t"))
+		}
+		w.Flush()
+	},
+}
+
+var configExampleCmd = &cobra.Command{
+	Use:   "config-example",
+	Short: "Print an example config file",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println(configFileExample)
+	},
 }
 
 func repoNameFromRes(res *codesearch.Result) string {
@@ -161,195 +289,452 @@ func repoNameFromRes(res *codesearch.Result) string {
 	return repoName
 }
 
-var searchCmd = &cobra.Command{
-	Use:   "search",
-	Short: "Search code in the specified backends",
-	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		config := getConfig()
+// savedSearchName returns the name of the saved search to run, if the first
+// argument is "@name" and there is a saved search with that name, or an empty
+// string. Other arguments starting with "@", like "@Override", are searched
+// as is.
+func savedSearchName(args []string) string {
+	name, ok := strings.CutPrefix(args[0], "@")
+	if !ok {
+		return ""
+	}
+	if _, ok := getConfig().SavedSearches[name]; !ok {
+		return ""
+	}
+	return name
+}
 
-		// get backends. Command line overrides config file, and "all" expands
-		// to all known backends in the config file.
-		var backendsToValidate = config.DefaultBackends
-		if searchBackends != "" {
-			backendsToValidate = strings.Split(searchBackends, ",")
-		}
-		var backendNames []string
-		for _, b := range backendsToValidate {
-			// Config.Validate has already ensured that there is either "all" or
-			// individual backend names.
-			if b == "all" {
-				// clear out backendNames in case other backends were
-				// appended
-				backendNames = make([]string, 0, len(config.Backends))
-				for name := range config.Backends {
-					backendNames = append(backendNames, name)
-				}
-				break
-			} else {
-				backendNames = append(backendNames, b)
+// newRequest builds the search request from the command line arguments and
+// flags. If the first argument is "@name" for a saved search, the request
+// starts from that saved search, and the other arguments are its parameters as
+// name=value. The flags given on the command line override the settings of
+// the saved search.
+func newRequest(cmd *cobra.Command, searcher *codesearch.Searcher, args []string) codesearch.Request {
+	searchString := strings.Join(args, " ")
+	var (
+		saved        codesearch.SavedSearch
+		langs        = flagLangs
+		include      = flagInclude
+		exclude      = flagExclude
+		linesBefore  = flagSearchContextBefore
+		linesAfter   = flagSearchContextAfter
+		backendNames []string
+	)
+	if name := savedSearchName(args); name != "" {
+		saved = getConfig().SavedSearches[name]
+		params := make(map[string]string)
+		for _, arg := range args[1:] {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				logrus.Fatalf("Invalid parameter %q for saved search %q, expected name=value", arg, name)
 			}
+			params[key] = value
+		}
+		var err error
+		searchString, err = saved.Expand(params)
+		if err != nil {
+			logrus.Fatalf("Failed to expand saved search %q: %v", name, err)
 		}
-		// get sorter to sort results later
-		sorter := getSorter(flagSort)
-		if sorter == nil {
-			log.Fatalf("Invalid value for --sort")
+		backendNames = saved.Backends
+		langs = append(slices.Clone(saved.Langs), flagLangs...)
+		// the globs of the command line apply after the saved ones, so they
+		// can override them
+		include = append(slices.Clone(saved.Include), flagInclude...)
+		exclude = append(slices.Clone(saved.Exclude), flagExclude...)
+		if !cmd.Flags().Changed("before") {
+			linesBefore = saved.LinesBefore
 		}
+		if !cmd.Flags().Changed("after") {
+			linesAfter = saved.LinesAfter
+		}
+	}
+	caseInsensitive := flagCaseInsensitive || saved.CaseInsensitive && !flagSmartCase
 
-		searchString := strings.Join(args, " ")
-		fmt.Fprintf(os.Stderr, "Searching %q on %q\n", searchString, backendNames)
-		backends := make([]codesearch.Backend, 0, len(backendNames))
-		for _, name := range backendNames {
-			backendConfig, ok := config.Backends[name]
-			if !ok {
-				logrus.Fatalf("Backend %q not found", name)
+	// get backends. Command line overrides saved search and config file, and
+	// "all" expands to all known backends in the config file.
+	if searchBackends != "" {
+		backendNames = strings.Split(searchBackends, ",")
+	}
+	backendNames, err := searcher.ResolveBackends(backendNames)
+	if err != nil {
+		logrus.Fatalf("Failed to get backends: %v", err)
+	}
+	if _, err := codesearch.NewSorter(flagSort); err != nil {
+		log.Fatalf("Invalid value for --sort")
+	}
+	scope, err := codesearch.ParseScope(flagScope)
+	if err != nil {
+		log.Fatalf("Invalid value for --scope")
+	}
+
+	query, err := codesearch.ParseQuery(searchString)
+	if err != nil {
+		logrus.Fatalf("Failed to parse query: %v", err)
+	}
+	if err := query.AddLangs(langs...); err != nil {
+		logrus.Fatalf("Invalid value for --lang: %v (known languages: %s)", err, strings.Join(codesearch.Languages(), ", "))
+	}
+	if flagRegex {
+		query.SetDefaultKind(codesearch.PatternRegexp)
+	}
+	if flagFixedStrings {
+		query.SetDefaultKind(codesearch.PatternLiteral)
+	}
+	// a case: qualifier in the query takes precedence
+	if flagSmartCase && query.Case == codesearch.CaseDefault {
+		query.Case = codesearch.CaseSmart
+	}
+	return codesearch.Request{
+		Query:    query,
+		Backends: backendNames,
+		Options: codesearch.NewSearchOptions(
+			codesearch.WithLinesBefore(linesBefore),
+			codesearch.WithLinesAfter(linesAfter),
+			codesearch.WithCaseInsensitive(caseInsensitive),
+			codesearch.WithSearchInFilenames(flagSearchInFilenames),
+			codesearch.WithWordRegexp(flagWordRegexp),
+			codesearch.WithSymbol(flagSymbol),
+			codesearch.WithScope(scope),
+			codesearch.WithInclude(include...),
+			codesearch.WithExclude(exclude...),
+		),
+		Sort:          flagSort,
+		Limit:         flagLimit,
+		Timeout:       flagTimeout,
+		MatchFilename: flagMatchFilename,
+	}
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search <query> | @saved-search [name=value...]",
+	Short: "Search code in the specified backends",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		searcher, err := codesearch.NewSearcher(getConfig())
+		if err != nil {
+			logrus.Fatalf("Failed to set up search: %v", err)
+		}
+		req := newRequest(cmd, searcher, args)
+		info := searchInfo{Query: req.Query.String(), SavedSearch: savedSearchName(args)}
+		w := os.Stdout
+		if flagOutput != "" {
+			w, err = os.Create(flagOutput)
+			if err != nil {
+				logrus.Fatalf("Failed to create output file: %v", err)
 			}
-			backend := codesearch.BackendByType(backendConfig.Type)
-			if backend == nil {
-				logrus.Fatalf("Failed to get backend for type %q", backendConfig.Type)
+			// no terminal colors in files
+			color.NoColor = true
+		}
+		var out formatter
+		if flagTemplate != "" || flagTemplateFile != "" {
+			text, err := loadTemplate(getConfig(), flagTemplate, flagTemplateFile)
+			if err != nil {
+				logrus.Fatalf("Failed to load template: %v", err)
 			}
-			var err error
-			backend, err = backend.New(
-				name, backendConfig.Params,
-			)
+			out, err = newTemplateFormatter(w, info, text)
 			if err != nil {
-				logrus.Fatalf("Failed to instantiate backend %q: %v", name, err)
+				logrus.Fatalf("Invalid value for --template: %v", err)
 			}
-			backends = append(backends, backend)
-		}
-		if len(backends) == 0 {
-			logrus.Fatal("No backends specified")
-		}
-		type stat struct {
-			name     string
-			duration time.Duration
-			results  int
-		}
-		stats := make([]stat, 0, len(backends))
-		searchStart := time.Now()
-		totalResults := 0
-		for _, b := range backends {
-			start := time.Now()
-			results, err := b.Search(
-				searchString,
-				codesearch.WithLinesBefore(flagSearchContextBefore),
-				codesearch.WithLinesAfter(flagSearchContextAfter),
-				codesearch.WithCaseInsensitive(flagCaseInsensitive),
-				codesearch.WithSearchInFilenames(flagSearchInFilenames),
-			)
+		} else {
+			out, err = newFormatter(flagFormat, w, info)
 			if err != nil {
-				logrus.Fatalf("Failed to search with backend %q: %v", b.Name(), err)
+				logrus.Fatalf("Invalid value for --format: %v", err)
 			}
-			st := stat{
-				name:     b.Name(),
-				duration: time.Since(start),
+		}
+		fmt.Fprintf(os.Stderr, "Searching %q on %q\n", req.Query.String(), req.Backends)
+		// interrupt the search on Ctrl-C
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		var (
+			localResults int
+			toOpen       *codesearch.Result
+		)
+		stats, err := searcher.Stream(ctx, req, func(res codesearch.Result) {
+			if err := out.Result(res); err != nil {
+				logrus.Fatalf("Failed to write result: %v", err)
 			}
-			// sort the results, if requested
-			results = sorter(results)
-			numResults := 0
-			fileNamesMap := make(map[string]*codesearch.Result)
-			for idx, res := range results {
-				repoName := repoNameFromRes(&res)
-				if flagLimit > 0 && uint(idx) >= flagLimit {
-					break
+			if _, ok := localPath(&res); ok {
+				localResults++
+				if localResults == flagOpen {
+					toOpen = &res
 				}
-				if flagSearchInFilenames {
-					// we are searching the pattern in the file name. Collect
-					// all of the first in a map to remove duplicates, then
-					// print them out later in this function
-					if strings.Contains(strings.ToLower(res.Path), strings.ToLower(searchString)) {
-						fileNamesMap[res.Path] = &res
-					}
+			}
+		})
+		if err != nil {
+			logrus.Fatalf("Search failed: %v", err)
+		}
+		if err := out.Close(stats); err != nil {
+			logrus.Fatalf("Failed to write results: %v", err)
+		}
+		if flagOutput != "" {
+			if err := w.Close(); err != nil {
+				logrus.Fatalf("Failed to write output file: %v", err)
+			}
+		}
+		for _, bs := range stats.Backends {
+			for _, w := range bs.Warnings {
+				logrus.Warnf("%s: %s", bs.Backend, w)
+			}
+		}
+		if flagStats {
+			for _, bs := range stats.Backends {
+				if bs.Err != nil {
+					fmt.Fprintf(os.Stderr, "Got %d results on %q in %s before failing: %v\n", bs.Results, bs.Backend, bs.Duration, bs.Err)
 				} else {
-					// we are searching the pattern in the file content
-					// get context lines
-					var before, after string
-					for idx, line := range res.Context.Before {
-						before += fmt.Sprintf("%d: %s\n", res.Lineno-(len(res.Context.Before)-idx), line)
-					}
-					for idx, line := range res.Context.After {
-						after += fmt.Sprintf("%d: %s\n", res.Lineno+idx+1, line)
-					}
-					if len(res.Context.After) > 0 {
-						after = "\n" + after
-					}
-					// get start and end of highlight
-					start, end := res.Highlight[0], res.Highlight[1]
-					if flagMatchFilename != "" {
-						if strings.Contains(strings.ToLower(res.Path), strings.ToLower(flagMatchFilename)) {
-							// only show the result if the file name matches the
-							// file pattern
-							if !res.IsFilename {
-								fmt.Printf(
-									"%s:%s:%s (%s)\n\n%s%s: %s%s\n\n",
-									res.Backend,
-									textBold.Sprint(toAnsiURL(res.RepoURL, repoName)),
-									textBold.Sprint(toAnsiURL(res.FileURL, res.Path)),
-									textBold.Sprint(res.Branch),
-									before,
-									textBoldGreen.Sprint(res.Lineno),
-									res.Line[:start]+textBoldRed.Sprint(res.Line[start:end])+res.Line[end:],
-									after,
-								)
-								numResults++
-							}
-						}
-					} else {
-						// no file name pattern specified, so show all the
-						// results
-						if res.IsFilename {
-							continue
-						}
-						fmt.Printf(
-							"%s:%s:%s (%s)\n\n%s%s: %s%s\n\n",
-							res.Backend,
-							textBold.Sprint(toAnsiURL(res.RepoURL, repoName)),
-							textBold.Sprint(toAnsiURL(res.FileURL, res.Path)),
-							textBold.Sprint(res.Branch),
-							before,
-							textBoldGreen.Sprint(res.Lineno),
-							res.Line[:start]+textBoldRed.Sprint(res.Line[start:end])+res.Line[end:],
-							after,
-						)
-						numResults++
-					}
+					fmt.Fprintf(os.Stderr, "Got %d results on %q in %s\n", bs.Results, bs.Backend, bs.Duration)
 				}
 			}
-			if flagSearchInFilenames {
-				// and now print the unique file names, if flagSearchInFilenames was
-				// requested
-				fileNames := make([]string, 0, len(fileNamesMap))
-				for name := range fileNamesMap {
-					fileNames = append(fileNames, name)
-				}
-				sort.Strings(fileNames)
-				for _, name := range fileNames {
-					res := fileNamesMap[name]
-					repoName := repoNameFromRes(res)
-					fmt.Printf(
-						"%s:%s:%s (%s)\n\n",
-						b.Name(),
-						textBold.Sprint(toAnsiURL(res.RepoURL, repoName)),
-						textBold.Sprint(toAnsiURL(res.FileURL, res.Path)),
-						textBold.Sprint(res.Branch),
-					)
-				}
-				numResults = len(fileNames)
+		}
+		fmt.Fprintf(os.Stderr, "Got %d total results in %s\n", stats.Results, stats.Duration)
+		if flagStats && stats.Results > 0 {
+			fmt.Fprintf(os.Stderr, "Results by language: %s\n", languageStats(stats.Languages))
+		}
+		if flagOpen > 0 {
+			if toOpen == nil {
+				logrus.Fatalf("Cannot open result %d, got %d results in local files", flagOpen, localResults)
+			}
+			if err := openInEditor(toOpen); err != nil {
+				logrus.Fatalf("Failed to open result %d: %v", flagOpen, err)
 			}
-			st.results = numResults
-			stats = append(stats, st)
-			totalResults += numResults
 		}
-		totalTime := time.Since(searchStart)
-		if flagStats {
-			for _, st := range stats {
-				fmt.Fprintf(os.Stderr, "Got %d results on %q in %s\n", st.results, st.name, st.duration)
+		if failed := stats.Failed(); len(failed) > 0 {
+			fmt.Fprintf(os.Stderr, "%d of %d backends failed:\n", len(failed), len(stats.Backends))
+			for _, bs := range failed {
+				fmt.Fprintf(os.Stderr, "  %s: %v\n", bs.Backend, bs.Err)
+				if hint := errorHint(bs.Err); hint != "" {
+					fmt.Fprintf(os.Stderr, "    %s\n", hint)
+				}
 			}
+			stop()
+			os.Exit(exitBackendsFailed)
+		}
+		if stats.Results == 0 {
+			stop()
+			os.Exit(exitNoResults)
 		}
-		fmt.Fprintf(os.Stderr, "Got %d total results in %s\n", totalResults, totalTime)
 	},
 }
 
+// languageStats formats the number of results per language, from the most
+// to the least common.
+func languageStats(langs map[string]int) string {
+	names := make([]string, 0, len(langs))
+	for lang := range langs {
+		names = append(names, lang)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if langs[names[i]] != langs[names[j]] {
+			return langs[names[i]] > langs[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, 0, len(names))
+	for _, lang := range names {
+		name := lang
+		if name == "" {
+			name = "unknown"
+		}
+		parts = append(parts, fmt.Sprintf("%s %d", name, langs[lang]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+var explainCmd = &cobra.Command{
+	Use:   "explain <query> | @saved-search [name=value...]",
+	Short: "Show how a search would run on each backend, without running it",
+	Long: "Show how a search would run on each backend: the native query sent to " +
+		"the backend, the filters applied to the results client-side, and an " +
+		"estimate of the cost. The remote backends are contacted to resolve " +
+		"groups and projects, and to count the results.",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		searcher, err := codesearch.NewSearcher(getConfig())
+		if err != nil {
+			logrus.Fatalf("Failed to set up search: %v", err)
+		}
+		req := newRequest(cmd, searcher, args)
+		fmt.Printf("Query: %s\n\n", req.Query.String())
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		plans, err := searcher.Explain(ctx, req)
+		if err != nil {
+			logrus.Fatalf("Explain failed: %v", err)
+		}
+		for _, plan := range plans {
+			fmt.Printf("%s (%s)\n", textBold.Sprint(plan.Backend), plan.Type)
+			printPlan(plan, "  ")
+			fmt.Println()
+		}
+	},
+}
+
+// printPlan prints a plan, and the plans of its patterns further indented.
+func printPlan(plan *codesearch.Plan, indent string) {
+	if plan.Err != nil {
+		fmt.Printf("%s%s %v\n", indent, textBoldRed.Sprint("error:"), plan.Err)
+		if hint := errorHint(plan.Err); hint != "" {
+			fmt.Printf("%s  %s\n", indent, hint)
+		}
+		return
+	}
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"native", plan.Native},
+		{"client-side", plan.ClientSide},
+		{"estimate", plan.Estimate},
+	}
+	for _, w := range plan.Warnings {
+		sections = append(sections, struct {
+			title string
+			lines []string
+		}{"warning", []string{w.Error()}})
+	}
+	for _, section := range sections {
+		for _, line := range section.lines {
+			fmt.Printf("%s%-12s %s\n", indent, section.title+":", line)
+		}
+	}
+	for _, sub := range plan.Patterns {
+		fmt.Printf("%spattern %s:\n", indent, sub.Query)
+		printPlan(sub, indent+"  ")
+	}
+}
+
+// errorHint returns a suggestion on how to fix a backend error, or an empty
+// string if there is none.
+func errorHint(err error) string {
+	var rlerr *codesearch.RateLimitError
+	switch {
+	case errors.As(err, &rlerr):
+		if rlerr.Reset.IsZero() {
+			return "The rate limit was exceeded, try again later"
+		}
+		return fmt.Sprintf("The rate limit was exceeded, try again after %s", rlerr.Reset.Local().Format(time.Kitchen))
+	case errors.Is(err, codesearch.ErrUnauthorized):
+		return "Check that the backend's token is valid and has the required scopes"
+	case errors.Is(err, codesearch.ErrIndexMissing):
+		return "Create the index with `cindex`, see https://github.com/google/codesearch"
+	case errors.Is(err, codesearch.ErrInvalidConfig):
+		return "Check the backend's parameters in the configuration file"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "The search timed out, use --timeout to change the timeout"
+	default:
+		return ""
+	}
+}
+
+// printResult prints a single search result in human-readable form.
+func printResult(w io.Writer, res codesearch.Result) error {
+	if res.IsFilename {
+		_, err := fmt.Fprintf(w, "%s\n\n", resultHeader(&res))
+		return err
+	}
+	// get context lines
+	var before, after string
+	for idx, line := range res.Context.Before {
+		before += fmt.Sprintf("%d: %s\n", res.Start.Line-(len(res.Context.Before)-idx), line)
+	}
+	for idx, line := range res.Context.After {
+		after += fmt.Sprintf("%d: %s\n", res.End.Line+idx+1, line)
+	}
+	if len(res.Context.After) > 0 {
+		after = "\n" + after
+	}
+	_, err := fmt.Fprintf(
+		w,
+		"%s\n\n%s%s%s\n\n",
+		resultHeader(&res),
+		before,
+		matchedLines(&res),
+		after,
+	)
+	return err
+}
+
+// resultHeader returns the line that introduces a result, with its backend,
+// repository, path, branch, language and symbol kind.
+func resultHeader(res *codesearch.Result) string {
+	header := fmt.Sprintf(
+		"%s:%s:%s (%s)",
+		res.Backend,
+		textBold.Sprint(toAnsiURL(res.RepoURL, repoNameFromRes(res))),
+		textBold.Sprint(toAnsiURL(res.FileURL, res.Path)),
+		textBold.Sprint(res.Branch),
+	)
+	var tags []string
+	if res.Language != "" {
+		tags = append(tags, res.Language)
+	}
+	if res.SymbolKind != "" {
+		tags = append(tags, string(res.SymbolKind))
+	}
+	if len(tags) > 0 {
+		header += " [" + strings.Join(tags, ", ") + "]"
+	}
+	return header
+}
+
+// matchedLines returns the matched lines of a result, prefixed by their line
+// numbers and with all the highlight ranges colored.
+func matchedLines(res *codesearch.Result) string {
+	lines := make([]string, 0, len(res.Lines))
+	for idx, line := range res.Lines {
+		lines = append(lines, fmt.Sprintf("%s: %s", textBoldGreen.Sprint(res.Start.Line+idx), highlight(line, res.LineHighlights(idx))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lineSegment is a part of a line, highlighted or not.
+type lineSegment struct {
+	Text      string
+	Highlight bool
+}
+
+// splitRanges splits a line in segments at the highlight ranges.
+func splitRanges(line string, highlights []codesearch.Range) []lineSegment {
+	var (
+		segments []lineSegment
+		prev     int
+	)
+	for _, hl := range highlights {
+		if hl.Start < prev || hl.End > len(line) {
+			// skip overlapping or out-of-bounds ranges
+			continue
+		}
+		if hl.Start > prev {
+			segments = append(segments, lineSegment{Text: line[prev:hl.Start]})
+		}
+		segments = append(segments, lineSegment{Text: line[hl.Start:hl.End], Highlight: true})
+		prev = hl.End
+	}
+	if prev < len(line) {
+		segments = append(segments, lineSegment{Text: line[prev:]})
+	}
+	return segments
+}
+
+// markRanges returns the line with the highlight ranges passed through mark.
+func markRanges(line string, highlights []codesearch.Range, mark func(string) string) string {
+	var sb strings.Builder
+	for _, seg := range splitRanges(line, highlights) {
+		if seg.Highlight {
+			sb.WriteString(mark(seg.Text))
+		} else {
+			sb.WriteString(seg.Text)
+		}
+	}
+	return sb.String()
+}
+
+// highlight returns the line with all the highlight ranges colored.
+func highlight(line string, highlights []codesearch.Range) string {
+	return markRanges(line, highlights, func(s string) string {
+		return textBoldRed.Sprint(s)
+	})
+}
+
 func toAnsiURL(url, text string) string {
 	return fmt.Sprintf("\033]8;;%s\033\\%s\033]8;;\033\\", url, text)
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/codesearch/pkg/codesearch"
+)
+
+// schemaVersion is the version of the records written by the json, jsonl and
+// csv formats. It changes when a field is removed or changes meaning, not
+// when a field is added. See "Output formats" in the README.
+const schemaVersion = 1
+
+// Record types of the jsonl format and of the type column of the csv format.
+const (
+	recordResult = "result"
+	recordStats  = "stats"
+)
+
+// resultRecord is the machine-readable form of a codesearch.Result.
+type resultRecord struct {
+	Type          string            `json:"type,omitempty"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
+	Backend       string            `json:"backend"`
+	Owner         string            `json:"owner"`
+	RepoName      string            `json:"repo_name"`
+	RepoURL       string            `json:"repo_url"`
+	Branch        string            `json:"branch"`
+	Path          string            `json:"path"`
+	FileURL       string            `json:"file_url"`
+	Language      string            `json:"language"`
+	SymbolKind    string            `json:"symbol_kind"`
+	IsFilename    bool              `json:"is_filename"`
+	Start         positionRecord    `json:"start"`
+	End           positionRecord    `json:"end"`
+	Lines         []string          `json:"lines"`
+	ContextBefore []string          `json:"context_before"`
+	ContextAfter  []string          `json:"context_after"`
+	Highlights    []highlightRecord `json:"highlights"`
+}
+
+type positionRecord struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type highlightRecord struct {
+	Line  int `json:"line"`
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// statsRecord is the machine-readable form of codesearch.Stats.
+type statsRecord struct {
+	Type          string               `json:"type,omitempty"`
+	SchemaVersion int                  `json:"schema_version,omitempty"`
+	DurationMs    float64              `json:"duration_ms"`
+	Results       int                  `json:"results"`
+	Languages     map[string]int       `json:"languages"`
+	Backends      []backendStatsRecord `json:"backends"`
+}
+
+type backendStatsRecord struct {
+	Backend    string         `json:"backend"`
+	DurationMs float64        `json:"duration_ms"`
+	Results    int            `json:"results"`
+	Languages  map[string]int `json:"languages"`
+	Warnings   []string       `json:"warnings"`
+	Error      string         `json:"error"`
+}
+
+func newResultRecord(res codesearch.Result) resultRecord {
+	rec := resultRecord{
+		Backend:       res.Backend,
+		Owner:         res.Owner,
+		RepoName:      res.RepoName,
+		RepoURL:       res.RepoURL,
+		Branch:        res.Branch,
+		Path:          res.Path,
+		FileURL:       res.FileURL,
+		Language:      res.Language,
+		SymbolKind:    string(res.SymbolKind),
+		IsFilename:    res.IsFilename,
+		Start:         positionRecord{Line: res.Start.Line, Column: res.Start.Column},
+		End:           positionRecord{Line: res.End.Line, Column: res.End.Column},
+		Lines:         nonNil(res.Lines),
+		ContextBefore: nonNil(res.Context.Before),
+		ContextAfter:  nonNil(res.Context.After),
+		Highlights:    make([]highlightRecord, 0, len(res.Highlights)),
+	}
+	for _, hl := range res.Highlights {
+		rec.Highlights = append(rec.Highlights, highlightRecord{Line: hl.Line, Start: hl.Start, End: hl.End})
+	}
+	return rec
+}
+
+func newStatsRecord(stats *codesearch.Stats) statsRecord {
+	rec := statsRecord{
+		DurationMs: durationMs(stats.Duration),
+		Results:    stats.Results,
+		Languages:  nonNilMap(stats.Languages),
+		Backends:   make([]backendStatsRecord, 0, len(stats.Backends)),
+	}
+	for _, bs := range stats.Backends {
+		brec := backendStatsRecord{
+			Backend:    bs.Backend,
+			DurationMs: durationMs(bs.Duration),
+			Results:    bs.Results,
+			Languages:  nonNilMap(bs.Languages),
+			Warnings:   make([]string, 0, len(bs.Warnings)),
+		}
+		for _, w := range bs.Warnings {
+			brec.Warnings = append(brec.Warnings, w.Error())
+		}
+		if bs.Err != nil {
+			brec.Error = bs.Err.Error()
+		}
+		rec.Backends = append(rec.Backends, brec)
+	}
+	return rec
+}
+
+// nonNil returns an empty slice instead of nil, so that empty lists are
+// encoded as [] rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func nonNilMap(m map[string]int) map[string]int {
+	if m == nil {
+		return map[string]int{}
+	}
+	return m
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// jsonFormatter writes a single JSON document with all the results and the
+// stats, once the search is complete.
+type jsonFormatter struct {
+	w       io.Writer
+	results []resultRecord
+}
+
+func newJSONFormatter(w io.Writer, info searchInfo) formatter {
+	return &jsonFormatter{w: w, results: []resultRecord{}}
+}
+
+func (f *jsonFormatter) Result(res codesearch.Result) error {
+	f.results = append(f.results, newResultRecord(res))
+	return nil
+}
+
+func (f *jsonFormatter) Close(stats *codesearch.Stats) error {
+	enc := json.NewEncoder(f.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		SchemaVersion int            `json:"schema_version"`
+		Results       []resultRecord `json:"results"`
+		Stats         statsRecord    `json:"stats"`
+	}{
+		SchemaVersion: schemaVersion,
+		Results:       f.results,
+		Stats:         newStatsRecord(stats),
+	})
+}
+
+// jsonlFormatter writes one JSON record per line: a record for each result
+// as soon as it is available, then a stats record.
+type jsonlFormatter struct {
+	enc *json.Encoder
+}
+
+func newJSONLFormatter(w io.Writer, info searchInfo) formatter {
+	return &jsonlFormatter{enc: json.NewEncoder(w)}
+}
+
+func (f *jsonlFormatter) Result(res codesearch.Result) error {
+	rec := newResultRecord(res)
+	rec.Type, rec.SchemaVersion = recordResult, schemaVersion
+	return f.enc.Encode(rec)
+}
+
+func (f *jsonlFormatter) Close(stats *codesearch.Stats) error {
+	rec := newStatsRecord(stats)
+	rec.Type, rec.SchemaVersion = recordStats, schemaVersion
+	return f.enc.Encode(rec)
+}
+
+// csvColumns are the columns of the csv format. Result rows leave the last
+// columns empty, and stats rows only set type, backend and the last columns.
+var csvColumns = []string{
+	"type", "schema_version", "backend", "owner", "repo_name", "repo_url",
+	"branch", "path", "file_url", "language", "symbol_kind", "is_filename",
+	"start_line", "start_column", "end_line", "end_column", "lines",
+	"context_before", "context_after", "highlights", "results",
+	"duration_ms", "error",
+}
+
+// csvFormatter writes a header, a row for each result as soon as it is
+// available, then a stats row for each backend and a total stats row with an
+// empty backend. Lists of lines are joined with newlines, and highlights are
+// written as "line:start-end", separated by spaces.
+type csvFormatter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func newCSVFormatter(w io.Writer, info searchInfo) formatter {
+	return &csvFormatter{w: csv.NewWriter(w)}
+}
+
+func (f *csvFormatter) write(row map[string]string) error {
+	if !f.wroteHeader {
+		if err := f.w.Write(csvColumns); err != nil {
+			return err
+		}
+		f.wroteHeader = true
+	}
+	record := make([]string, 0, len(csvColumns))
+	for _, col := range csvColumns {
+		record = append(record, row[col])
+	}
+	if err := f.w.Write(record); err != nil {
+		return err
+	}
+	// flush every row, so that results are streamed
+	f.w.Flush()
+	return f.w.Error()
+}
+
+func (f *csvFormatter) Result(res codesearch.Result) error {
+	rec := newResultRecord(res)
+	highlights := make([]string, 0, len(rec.Highlights))
+	for _, hl := range rec.Highlights {
+		highlights = append(highlights, fmt.Sprintf("%d:%d-%d", hl.Line, hl.Start, hl.End))
+	}
+	return f.write(map[string]string{
+		"type":           recordResult,
+		"schema_version": strconv.Itoa(schemaVersion),
+		"backend":        rec.Backend,
+		"owner":          rec.Owner,
+		"repo_name":      rec.RepoName,
+		"repo_url":       rec.RepoURL,
+		"branch":         rec.Branch,
+		"path":           rec.Path,
+		"file_url":       rec.FileURL,
+		"language":       rec.Language,
+		"symbol_kind":    rec.SymbolKind,
+		"is_filename":    strconv.FormatBool(rec.IsFilename),
+		"start_line":     strconv.Itoa(rec.Start.Line),
+		"start_column":   strconv.Itoa(rec.Start.Column),
+		"end_line":       strconv.Itoa(rec.End.Line),
+		"end_column":     strconv.Itoa(rec.End.Column),
+		"lines":          strings.Join(rec.Lines, "\n"),
+		"context_before": strings.Join(rec.ContextBefore, "\n"),
+		"context_after":  strings.Join(rec.ContextAfter, "\n"),
+		"highlights":     strings.Join(highlights, " "),
+	})
+}
+
+func (f *csvFormatter) Close(stats *codesearch.Stats) error {
+	rec := newStatsRecord(stats)
+	for _, brec := range rec.Backends {
+		if err := f.write(map[string]string{
+			"type":           recordStats,
+			"schema_version": strconv.Itoa(schemaVersion),
+			"backend":        brec.Backend,
+			"results":        strconv.Itoa(brec.Results),
+			"duration_ms":    strconv.FormatFloat(brec.DurationMs, 'f', 3, 64),
+			"error":          brec.Error,
+		}); err != nil {
+			return err
+		}
+	}
+	return f.write(map[string]string{
+		"type":           recordStats,
+		"schema_version": strconv.Itoa(schemaVersion),
+		"results":        strconv.Itoa(rec.Results),
+		"duration_ms":    strconv.FormatFloat(rec.DurationMs, 'f', 3, 64),
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/insomniacslk/codesearch/pkg/codesearch"
+)
+
+// The sarif format writes a SARIF 2.1.0 log, for the code scanning tools.
+// Only the subset of the format that describes the results is defined here,
+// see https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool                     sarifTool                        `json:"tool"`
+	Invocations              []sarifInvocation                `json:"invocations"`
+	OriginalURIBaseIDs       map[string]sarifArtifactLocation `json:"originalUriBaseIds,omitempty"`
+	VersionControlProvenance []sarifVersionControlDetails     `json:"versionControlProvenance,omitempty"`
+	ColumnKind               string                           `json:"columnKind"`
+	Results                  []sarifResult                    `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful        bool                `json:"executionSuccessful"`
+	ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level   string       `json:"level"`
+	Message sarifMessage `json:"message"`
+}
+
+type sarifVersionControlDetails struct {
+	RepositoryURI string                `json:"repositoryUri"`
+	Branch        string                `json:"branch,omitempty"`
+	MappedTo      sarifArtifactLocation `json:"mappedTo"`
+}
+
+type sarifArtifactLocation struct {
+	URI       string `json:"uri,omitempty"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type sarifResult struct {
+	RuleID     string            `json:"ruleId"`
+	RuleIndex  int               `json:"ruleIndex"`
+	Level      string            `json:"level"`
+	Message    sarifMessage      `json:"message"`
+	Locations  []sarifLocation   `json:"locations"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+	ContextRegion    *sarifRegion          `json:"contextRegion,omitempty"`
+}
+
+type sarifRegion struct {
+	StartLine   int           `json:"startLine"`
+	StartColumn int           `json:"startColumn,omitempty"`
+	EndLine     int           `json:"endLine"`
+	EndColumn   int           `json:"endColumn,omitempty"`
+	Snippet     *sarifMessage `json:"snippet,omitempty"`
+}
+
+// sarifFormatter writes a SARIF log with a single run and a single rule for
+// the search, once the search is complete. Each repository is a base URI of
+// the run, and the paths of the results are relative to it.
+type sarifFormatter struct {
+	w       io.Writer
+	info    searchInfo
+	run     sarifRun
+	repoIDs map[string]string
+}
+
+func newSARIFFormatter(w io.Writer, info searchInfo) formatter {
+	ruleID := info.ruleID()
+	return &sarifFormatter{
+		w:    w,
+		info: info,
+		run: sarifRun{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           progname,
+				InformationURI: "https://github.com/insomniacslk/codesearch",
+				Rules: []sarifRule{{
+					ID:               ruleID,
+					ShortDescription: sarifMessage{Text: fmt.Sprintf("Matches of the search %q", info.Query)},
+				}},
+			}},
+			OriginalURIBaseIDs: make(map[string]sarifArtifactLocation),
+			ColumnKind:         "unicodeCodePoints",
+			Results:            []sarifResult{},
+		},
+		repoIDs: make(map[string]string),
+	}
+}
+
+// repoBaseID returns the base URI id of the repository of a result, adding
+// the repository to the run the first time.
+func (f *sarifFormatter) repoBaseID(res *codesearch.Result) string {
+	if res.RepoURL == "" {
+		return ""
+	}
+	if id, ok := f.repoIDs[res.RepoURL]; ok {
+		return id
+	}
+	id := fmt.Sprintf("REPO%d", len(f.repoIDs)+1)
+	f.repoIDs[res.RepoURL] = id
+	f.run.OriginalURIBaseIDs[id] = sarifArtifactLocation{URI: strings.TrimSuffix(res.RepoURL, "/") + "/"}
+	f.run.VersionControlProvenance = append(f.run.VersionControlProvenance, sarifVersionControlDetails{
+		RepositoryURI: res.RepoURL,
+		Branch:        res.Branch,
+		MappedTo:      sarifArtifactLocation{URIBaseID: id},
+	})
+	return id
+}
+
+// sarifColumn converts a 1-based byte column on a line to the 1-based column
+// in code points that SARIF expects.
+func sarifColumn(line string, column int) int {
+	if column < 1 || column-1 > len(line) {
+		return column
+	}
+	return utf8.RuneCountInString(line[:column-1]) + 1
+}
+
+func (f *sarifFormatter) Result(res codesearch.Result) error {
+	location := sarifPhysicalLocation{
+		ArtifactLocation: sarifArtifactLocation{
+			// a relative reference, escaped as needed
+			URI:       (&url.URL{Path: strings.TrimPrefix(res.Path, "/")}).String(),
+			URIBaseID: f.repoBaseID(&res),
+		},
+	}
+	message := fmt.Sprintf("The file name matches the search %q", f.info.Query)
+	if !res.IsFilename && len(res.Lines) > 0 {
+		message = fmt.Sprintf("Match of the search %q", f.info.Query)
+		if res.SymbolKind != "" {
+			message = fmt.Sprintf("Definition (%s) matching the search %q", res.SymbolKind, f.info.Query)
+		}
+		location.Region = &sarifRegion{
+			StartLine:   res.Start.Line,
+			StartColumn: sarifColumn(res.Lines[0], res.Start.Column),
+			EndLine:     res.End.Line,
+			EndColumn:   sarifColumn(res.Lines[len(res.Lines)-1], res.End.Column),
+			Snippet:     &sarifMessage{Text: strings.Join(res.Lines, "\n")},
+		}
+		if len(res.Context.Before) > 0 || len(res.Context.After) > 0 {
+			lines := append(append(append([]string(nil), res.Context.Before...), res.Lines...), res.Context.After...)
+			location.ContextRegion = &sarifRegion{
+				StartLine: res.Start.Line - len(res.Context.Before),
+				EndLine:   res.End.Line + len(res.Context.After),
+				Snippet:   &sarifMessage{Text: strings.Join(lines, "\n")},
+			}
+		}
+	}
+	properties := map[string]string{"backend": res.Backend}
+	if res.Language != "" {
+		properties["language"] = res.Language
+	}
+	if res.FileURL != "" {
+		properties["fileUrl"] = res.FileURL
+	}
+	f.run.Results = append(f.run.Results, sarifResult{
+		RuleID:     f.run.Tool.Driver.Rules[0].ID,
+		RuleIndex:  0,
+		Level:      "warning",
+		Message:    sarifMessage{Text: message},
+		Locations:  []sarifLocation{{PhysicalLocation: location}},
+		Properties: properties,
+	})
+	return nil
+}
+
+func (f *sarifFormatter) Close(stats *codesearch.Stats) error {
+	invocation := sarifInvocation{ExecutionSuccessful: len(stats.Failed()) == 0}
+	for _, bs := range stats.Backends {
+		for _, w := range bs.Warnings {
+			invocation.ToolExecutionNotifications = append(invocation.ToolExecutionNotifications, sarifNotification{
+				Level:   "warning",
+				Message: sarifMessage{Text: fmt.Sprintf("%s: %v", bs.Backend, w)},
+			})
+		}
+		if bs.Err != nil {
+			invocation.ToolExecutionNotifications = append(invocation.ToolExecutionNotifications, sarifNotification{
+				Level:   "error",
+				Message: sarifMessage{Text: fmt.Sprintf("%s: %v", bs.Backend, bs.Err)},
+			})
+		}
+	}
+	f.run.Invocations = []sarifInvocation{invocation}
+	enc := json.NewEncoder(f.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs:    []sarifRun{f.run},
+	})
+}
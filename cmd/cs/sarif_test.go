@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/codesearch/pkg/codesearch"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// sarifTestResults are results covering the cases of the format: multi-line
+// matches with context, file name matches, non-ASCII lines, and repositories
+// with and without a trailing slash in their URL.
+var sarifTestResults = []codesearch.Result{
+	{
+		Backend:    "gh",
+		Lines:      []string{"func main() {", "\tfmt.Println(\"hello\")"},
+		Start:      codesearch.Position{Line: 10, Column: 6},
+		End:        codesearch.Position{Line: 11, Column: 13},
+		Context:    codesearch.ResultContext{Before: []string{"// main is the entry point"}, After: []string{"}"}},
+		Highlights: []codesearch.Range{{Line: 0, Start: 5, End: 13}, {Line: 1, Start: 0, End: 12}},
+		Path:       "cmd/hello/main.go",
+		RepoURL:    "https://github.com/example/hello",
+		FileURL:    "https://github.com/example/hello/blob/main/cmd/hello/main.go#L10",
+		Owner:      "example",
+		RepoName:   "hello",
+		Branch:     "main",
+		Language:   "go",
+	},
+	{
+		Backend:    "gh",
+		IsFilename: true,
+		Path:       "docs/hello world.md",
+		RepoURL:    "https://github.com/example/hello",
+		FileURL:    "https://github.com/example/hello/blob/main/docs/hello%20world.md",
+		Owner:      "example",
+		RepoName:   "hello",
+		Branch:     "main",
+		Language:   "markdown",
+	},
+	{
+		Backend:    "gl",
+		Lines:      []string{"héllo wörld = 1"},
+		Start:      codesearch.Position{Line: 3, Column: 8},
+		End:        codesearch.Position{Line: 3, Column: 14},
+		Highlights: []codesearch.Range{{Line: 0, Start: 7, End: 13}},
+		Path:       "src/wörld.py",
+		RepoURL:    "https://gitlab.com/example/world/",
+		FileURL:    "https://gitlab.com/example/world/-/blob/main/src/w%C3%B6rld.py#L3",
+		Owner:      "example",
+		RepoName:   "world",
+		Language:   "python",
+	},
+}
+
+// renderSARIF returns the SARIF log written for the test results, with a
+// failed backend, decoded and as written.
+func renderSARIF(t *testing.T) (sarifLog, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	f := newSARIFFormatter(&buf, searchInfo{Query: "hello", SavedSearch: "hello-world"})
+	for _, res := range sarifTestResults {
+		if err := f.Result(res); err != nil {
+			t.Fatalf("Result failed: %v", err)
+		}
+	}
+	stats := &codesearch.Stats{
+		Backends: []codesearch.BackendStats{
+			{Backend: "gh", Results: 2, Warnings: []error{errors.New("case-sensitive search is emulated")}},
+			{Backend: "gl", Results: 1},
+			{Backend: "broken", Err: errors.New("401 Unauthorized")},
+		},
+		Results: 3,
+	}
+	if err := f.Close(stats); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	return log, buf.Bytes()
+}
+
+// TestSARIFSchema validates the log against the official SARIF 2.1.0 schema,
+// https://docs.oasis-open.org/sarif/sarif/v2.1.0/errata01/os/schemas/sarif-schema-2.1.0.json
+func TestSARIFSchema(t *testing.T) {
+	f, err := os.Open("testdata/sarif-schema-2.1.0.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	doc, err := jsonschema.UnmarshalJSON(f)
+	if err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+	c := jsonschema.NewCompiler()
+	c.AssertFormat()
+	if err := c.AddResource("sarif-schema-2.1.0.json", doc); err != nil {
+		t.Fatal(err)
+	}
+	sch, err := c.Compile("sarif-schema-2.1.0.json")
+	if err != nil {
+		t.Fatalf("failed to compile schema: %v", err)
+	}
+	_, data := renderSARIF(t)
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if err := sch.Validate(inst); err != nil {
+		t.Errorf("invalid SARIF log: %v", err)
+	}
+}
+
+func TestSARIFLog(t *testing.T) {
+	log, _ := renderSARIF(t)
+	if log.Version != "2.1.0" {
+		t.Errorf("version = %q, want 2.1.0", log.Version)
+	}
+	if len(log.Runs) != 1 {
+		t.Fatalf("got %d runs, want 1", len(log.Runs))
+	}
+	run := log.Runs[0]
+	if run.Tool.Driver.Name != progname {
+		t.Errorf("runs[0].tool.driver.name = %q, want %q", run.Tool.Driver.Name, progname)
+	}
+	if len(run.Results) != len(sarifTestResults) {
+		t.Fatalf("got %d results, want %d", len(run.Results), len(sarifTestResults))
+	}
+	rules := run.Tool.Driver.Rules
+	for idx, res := range run.Results {
+		if res.RuleIndex < 0 || res.RuleIndex >= len(rules) {
+			t.Errorf("results[%d].ruleIndex = %d, out of the %d rules", idx, res.RuleIndex, len(rules))
+			continue
+		}
+		if rules[res.RuleIndex].ID != res.RuleID {
+			t.Errorf("results[%d].ruleId = %q, but rules[%d].id = %q", idx, res.RuleID, res.RuleIndex, rules[res.RuleIndex].ID)
+		}
+	}
+	if len(run.OriginalURIBaseIDs) != 2 {
+		t.Errorf("got %d originalUriBaseIds, want 2", len(run.OriginalURIBaseIDs))
+	}
+	for id, loc := range run.OriginalURIBaseIDs {
+		if !strings.HasSuffix(loc.URI, "/") {
+			t.Errorf("originalUriBaseIds[%s].uri = %q, must end with /", id, loc.URI)
+		}
+	}
+	for idx, res := range run.Results {
+		uriBaseID := res.Locations[0].PhysicalLocation.ArtifactLocation.URIBaseID
+		if _, ok := run.OriginalURIBaseIDs[uriBaseID]; !ok {
+			t.Errorf("results[%d] has unknown uriBaseId %q", idx, uriBaseID)
+		}
+	}
+}
+
+func TestSARIFRegions(t *testing.T) {
+	log, _ := renderSARIF(t)
+	results := log.Runs[0].Results
+
+	// multi-line match with context
+	loc := results[0].Locations[0].PhysicalLocation
+	if loc.ArtifactLocation.URI != "cmd/hello/main.go" {
+		t.Errorf("uri = %q, want cmd/hello/main.go", loc.ArtifactLocation.URI)
+	}
+	want := sarifRegion{StartLine: 10, StartColumn: 6, EndLine: 11, EndColumn: 13, Snippet: &sarifMessage{Text: "func main() {\n\tfmt.Println(\"hello\")"}}
+	if loc.Region == nil || *loc.Region.Snippet != *want.Snippet || loc.Region.StartLine != want.StartLine || loc.Region.StartColumn != want.StartColumn || loc.Region.EndLine != want.EndLine || loc.Region.EndColumn != want.EndColumn {
+		t.Errorf("region = %+v, want %+v", loc.Region, want)
+	}
+	if loc.ContextRegion == nil || loc.ContextRegion.StartLine != 9 || loc.ContextRegion.EndLine != 12 {
+		t.Errorf("contextRegion = %+v, want lines 9 to 12", loc.ContextRegion)
+	}
+
+	// file name match: no region, escaped path
+	loc = results[1].Locations[0].PhysicalLocation
+	if loc.Region != nil || loc.ContextRegion != nil {
+		t.Errorf("file name result has a region: %+v", loc.Region)
+	}
+	if loc.ArtifactLocation.URI != "docs/hello%20world.md" {
+		t.Errorf("uri = %q, want docs/hello%%20world.md", loc.ArtifactLocation.URI)
+	}
+
+	// columns in code points: "wörld" starts at byte 8 but code point 7
+	loc = results[2].Locations[0].PhysicalLocation
+	if loc.Region == nil || loc.Region.StartColumn != 7 || loc.Region.EndColumn != 12 {
+		t.Errorf("region = %+v, want columns 7 to 12", loc.Region)
+	}
+}
+
+func TestSARIFFailedBackend(t *testing.T) {
+	log, _ := renderSARIF(t)
+	invocations := log.Runs[0].Invocations
+	if len(invocations) != 1 {
+		t.Fatalf("got %d invocations, want 1", len(invocations))
+	}
+	if invocations[0].ExecutionSuccessful {
+		t.Error("executionSuccessful = true with a failed backend")
+	}
+	var levels []string
+	for _, n := range invocations[0].ToolExecutionNotifications {
+		levels = append(levels, n.Level+": "+n.Message.Text)
+	}
+	wantLevels := []string{"warning: gh: case-sensitive search is emulated", "error: broken: 401 Unauthorized"}
+	if !slices.Equal(levels, wantLevels) {
+		t.Errorf("notifications = %q, want %q", levels, wantLevels)
+	}
+}
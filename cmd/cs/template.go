@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/insomniacslk/codesearch/pkg/codesearch"
+)
+
+// Names of the optional templates that are written before and after the
+// results, defined with {{define "header"}}...{{end}} in the template text.
+const (
+	templateHeader = "header"
+	templateFooter = "footer"
+)
+
+// templateSummary is the data of the header and footer templates.
+type templateSummary struct {
+	// Query is the query, as returned by Query.String.
+	Query string
+	// SavedSearch is the name of the saved search, if any.
+	SavedSearch string
+	Stats       *codesearch.Stats
+}
+
+// templateFuncs are the helper functions available in the templates.
+var templateFuncs = template.FuncMap{
+	// highlight returns the matched lines of a result, with the matches
+	// between the given markers, or colored if there are none, e.g.
+	// {{highlight . "**" "**"}}
+	"highlight": func(res codesearch.Result, markers ...string) (string, error) {
+		if len(markers) != 0 && len(markers) != 2 {
+			return "", fmt.Errorf("highlight takes either no markers or an opening and a closing marker")
+		}
+		lines := make([]string, 0, len(res.Lines))
+		for idx, line := range res.Lines {
+			if len(markers) == 0 {
+				lines = append(lines, highlight(line, res.LineHighlights(idx)))
+				continue
+			}
+			lines = append(lines, markRanges(line, res.LineHighlights(idx), func(s string) string {
+				return markers[0] + s + markers[1]
+			}))
+		}
+		return strings.Join(lines, "\n"), nil
+	},
+	// url joins a base URL and path elements, escaping the elements, e.g.
+	// {{url .RepoURL "blob" .Branch .Path}}
+	"url": url.JoinPath,
+	// truncate shortens a string to at most n characters, ending with an
+	// ellipsis if it was shortened, e.g. {{.Line | truncate 80}}
+	"truncate": func(n int, s string) string {
+		if n <= 0 || utf8.RuneCountInString(s) <= n {
+			return s
+		}
+		runes := []rune(s)
+		return string(runes[:max(n-1, 0)]) + "…"
+	},
+	// repo returns the owner and the name of the repository of a result
+	"repo": func(res codesearch.Result) string {
+		return repoNameFromRes(&res)
+	},
+	"join": strings.Join,
+}
+
+// loadTemplate returns the text of the template given with --template or
+// --template-file: the template of the configuration file with that name,
+// the content of the file, or else the inline template text.
+func loadTemplate(config *codesearch.Config, inline, file string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read template file: %w", err)
+		}
+		return string(data), nil
+	}
+	if text, ok := config.Templates[inline]; ok {
+		return text, nil
+	}
+	return inline, nil
+}
+
+// templateFormatter executes a text/template for each result. The header
+// and footer templates, if defined, receive a templateSummary with the stats
+// of the search. Since the stats are only known at the end of the search,
+// the results are buffered when there is a header.
+type templateFormatter struct {
+	w      io.Writer
+	info   searchInfo
+	tmpl   *template.Template
+	out    io.Writer
+	buffer bytes.Buffer
+}
+
+func newTemplateFormatter(w io.Writer, info searchInfo, text string) (formatter, error) {
+	tmpl, err := template.New("result").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	f := templateFormatter{w: w, info: info, tmpl: tmpl, out: w}
+	if tmpl.Lookup(templateHeader) != nil {
+		f.out = &f.buffer
+	}
+	return &f, nil
+}
+
+func (f *templateFormatter) Result(res codesearch.Result) error {
+	var sb strings.Builder
+	if err := f.tmpl.Execute(&sb, res); err != nil {
+		return fmt.Errorf("failed to execute template: %w", err)
+	}
+	// each result is on its own line, unless the template ends with one
+	text := sb.String()
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	_, err := io.WriteString(f.out, text)
+	return err
+}
+
+func (f *templateFormatter) Close(stats *codesearch.Stats) error {
+	summary := templateSummary{Query: f.info.Query, SavedSearch: f.info.SavedSearch, Stats: stats}
+	if f.tmpl.Lookup(templateHeader) != nil {
+		if err := f.tmpl.ExecuteTemplate(f.w, templateHeader, summary); err != nil {
+			return fmt.Errorf("failed to execute header template: %w", err)
+		}
+		if _, err := f.buffer.WriteTo(f.w); err != nil {
+			return err
+		}
+	}
+	if f.tmpl.Lookup(templateFooter) != nil {
+		if err := f.tmpl.ExecuteTemplate(f.w, templateFooter, summary); err != nil {
+			return fmt.Errorf("failed to execute footer template: %w", err)
+		}
+	}
+	return nil
+}
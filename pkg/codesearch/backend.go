@@ -1,55 +1,124 @@
 package codesearch
 
+import (
+	"context"
+	"iter"
+	"time"
+)
+
 type Backend interface {
-	New(name string, params BackendParams) (Backend, error)
 	Name() string
-	Type() string
-	SetLinesBefore(n int)
-	SetLinesAfter(n int)
-	SetCaseInsensitive(v bool)
-	SetSearchInFilenames(v bool)
-	Search(terms string, opts ...Opt) (Results, error)
+	Type() BackendType
+	// Capabilities describes the features that the backend supports
+	// natively.
+	Capabilities() Capabilities
+	// Search returns an iterator over the results. Results are emitted as soon
+	// as they are available. If the search fails, the last element emitted
+	// carries a non-nil error, and the iteration stops.
+	// The backend translates the query to its native syntax, and ignores
+	// the qualifiers that it does not list in its capabilities.
+	Search(ctx context.Context, q *Query, opts SearchOptions) iter.Seq2[Result, error]
+}
+
+// SearchOptions holds the options of a single query. It is passed by value to
+// Backend.Search, so the same backend can serve concurrent queries with
+// different options.
+type SearchOptions struct {
+	LinesBefore       int
+	LinesAfter        int
+	CaseInsensitive   bool
+	SearchInFilenames bool
+	// WordRegexp only keeps the matches that start and end at word
+	// boundaries.
+	WordRegexp bool
+	// Scope is the unit on which boolean queries are evaluated.
+	Scope Scope
+	// Include and Exclude are the globs that select the files to search by
+	// path, see PathFilter.
+	Include []string
+	Exclude []string
+	// Symbol only returns the definitions of the symbols whose name matches
+	// the terms, e.g. functions and types, rather than all their uses. See
+	// ExtractSymbols.
+	Symbol bool
+}
+
+// NewSearchOptions returns the SearchOptions built by applying the given
+// options in order.
+func NewSearchOptions(opts ...Opt) SearchOptions {
+	var o SearchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
-type Opt func(b Backend)
+type Opt func(o *SearchOptions)
 
 func WithLinesBefore(n int) Opt {
-	return func(b Backend) {
-		b.SetLinesBefore(n)
+	return func(o *SearchOptions) {
+		o.LinesBefore = n
 	}
 }
 
 func WithLinesAfter(n int) Opt {
-	return func(b Backend) {
-		b.SetLinesAfter(n)
+	return func(o *SearchOptions) {
+		o.LinesAfter = n
 	}
 }
 
 func WithCaseInsensitive(v bool) Opt {
-	return func(b Backend) {
-		b.SetCaseInsensitive(v)
+	return func(o *SearchOptions) {
+		o.CaseInsensitive = v
 	}
 }
 
 func WithSearchInFilenames(v bool) Opt {
-	return func(b Backend) {
-		b.SetSearchInFilenames(v)
-	}
-}
-
-func BackendByType(t BackendType) Backend {
-	switch t {
-	case BackendTypeGithub:
-		return &Github{}
-	case BackendTypeGitlab:
-		return &Gitlab{}
-		/*
-			case BackendTypeBitbucket:
-				return &Bitbucket{}
-		*/
-	case BackendTypeCsearch:
-		return &Csearch{}
-	default:
+	return func(o *SearchOptions) {
+		o.SearchInFilenames = v
+	}
+}
+
+func WithWordRegexp(v bool) Opt {
+	return func(o *SearchOptions) {
+		o.WordRegexp = v
+	}
+}
+
+func WithScope(s Scope) Opt {
+	return func(o *SearchOptions) {
+		o.Scope = s
+	}
+}
+
+func WithInclude(globs ...string) Opt {
+	return func(o *SearchOptions) {
+		o.Include = append(o.Include, globs...)
+	}
+}
+
+func WithExclude(globs ...string) Opt {
+	return func(o *SearchOptions) {
+		o.Exclude = append(o.Exclude, globs...)
+	}
+}
+
+func WithSymbol(v bool) Opt {
+	return func(o *SearchOptions) {
+		o.Symbol = v
+	}
+}
+
+// sleepContext waits for the given duration, or until the context is done,
+// whichever comes first. It returns the context's error if the context is done
+// before the duration has elapsed.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
 		return nil
 	}
 }
@@ -0,0 +1,297 @@
+package codesearch
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"regexp"
+	"strings"
+)
+
+// ExprOp is the operator of a boolean expression node.
+type ExprOp int
+
+const (
+	// ExprPattern is a leaf, matching a single pattern.
+	ExprPattern ExprOp = iota
+	ExprAnd
+	ExprOr
+	ExprNot
+)
+
+// Expr is a boolean expression of patterns. Leaves have Op set to
+// ExprPattern, and use Pattern and Kind. The other nodes combine their Subs.
+type Expr struct {
+	Op      ExprOp
+	Pattern string
+	Kind    PatternKind
+	Subs    []*Expr
+}
+
+// Scope is the unit on which the boolean expressions are evaluated.
+type Scope int
+
+const (
+	// ScopeFile evaluates boolean queries on whole files, e.g. "foo AND NOT
+	// bar" returns the lines matching foo in the files that don't contain
+	// bar.
+	ScopeFile Scope = iota
+	// ScopeLine evaluates boolean queries on each matching line, e.g. "foo
+	// AND NOT bar" returns the lines matching foo that don't contain bar.
+	ScopeLine
+)
+
+// ParseScope returns the scope with the given name, "file" or "line".
+func ParseScope(name string) (Scope, error) {
+	switch name {
+	case "file", "":
+		return ScopeFile, nil
+	case "line":
+		return ScopeLine, nil
+	default:
+		return ScopeFile, fmt.Errorf("%w: invalid scope %q", ErrInvalidQuery, name)
+	}
+}
+
+// combine returns an AND or OR node of left and right, flattening nested
+// nodes with the same operator.
+func combine(op ExprOp, left, right *Expr) *Expr {
+	var subs []*Expr
+	for _, e := range []*Expr{left, right} {
+		if e.Op == op {
+			subs = append(subs, e.Subs...)
+		} else {
+			subs = append(subs, e)
+		}
+	}
+	return &Expr{Op: op, Subs: subs}
+}
+
+// String returns the expression in the syntax accepted by ParseQuery.
+func (e *Expr) String() string {
+	var parts []string
+	for _, sub := range e.Subs {
+		s := sub.String()
+		if (e.Op == ExprAnd || e.Op == ExprNot) && sub.Op == ExprOr || e.Op == ExprNot && sub.Op == ExprAnd {
+			s = "(" + s + ")"
+		}
+		parts = append(parts, s)
+	}
+	switch e.Op {
+	case ExprAnd:
+		return strings.Join(parts, " AND ")
+	case ExprOr:
+		return strings.Join(parts, " OR ")
+	case ExprNot:
+		return "NOT " + parts[0]
+	default:
+		return formatPattern(e.Pattern, e.Kind)
+	}
+}
+
+// leaves returns all the leaves of the expression.
+func (e *Expr) leaves() []*Expr {
+	if e.Op == ExprPattern {
+		return []*Expr{e}
+	}
+	var leaves []*Expr
+	for _, sub := range e.Subs {
+		leaves = append(leaves, sub.leaves()...)
+	}
+	return leaves
+}
+
+// positiveLeaves returns the leaves that are not negated, i.e. the ones under
+// an even number of NOTs.
+func (e *Expr) positiveLeaves() map[*Expr]bool {
+	positive := make(map[*Expr]bool)
+	var walk func(e *Expr, negated bool)
+	walk = func(e *Expr, negated bool) {
+		switch e.Op {
+		case ExprPattern:
+			if !negated {
+				positive[e] = true
+			}
+		case ExprNot:
+			walk(e.Subs[0], !negated)
+		default:
+			for _, sub := range e.Subs {
+				walk(sub, negated)
+			}
+		}
+	}
+	walk(e, false)
+	return positive
+}
+
+// eval evaluates the expression, given the value of each leaf.
+func (e *Expr) eval(leafValue func(leaf *Expr) bool) bool {
+	switch e.Op {
+	case ExprAnd:
+		for _, sub := range e.Subs {
+			if !sub.eval(leafValue) {
+				return false
+			}
+		}
+		return true
+	case ExprOr:
+		for _, sub := range e.Subs {
+			if sub.eval(leafValue) {
+				return true
+			}
+		}
+		return false
+	case ExprNot:
+		return !e.Subs[0].eval(leafValue)
+	default:
+		return leafValue(e)
+	}
+}
+
+// isFlat returns true if the expression is an AND of patterns and negated
+// patterns, or an OR of patterns, without regexps. These are the boolean
+// queries that the backends with boolean support can run natively.
+func (e *Expr) isFlat() bool {
+	for _, sub := range e.Subs {
+		leaf := sub
+		if e.Op == ExprAnd && sub.Op == ExprNot {
+			leaf = sub.Subs[0]
+		}
+		if leaf.Op != ExprPattern || leaf.Kind == PatternRegexp {
+			return false
+		}
+	}
+	return e.Op == ExprAnd || e.Op == ExprOr
+}
+
+// leafRegexp compiles a leaf to a regexp, to match it locally. Patterns with
+// the default kind are regexps only if the backend interprets them as such.
+func leafRegexp(leaf *Expr, caps Capabilities, caseInsensitive, word bool) (*regexp.Regexp, error) {
+	pattern := leaf.Pattern
+	if leaf.Kind == PatternLiteral || leaf.Kind == PatternDefault && !caps.DefaultRegexp {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if word {
+		pattern = wordPattern(pattern)
+	}
+	if caseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidQuery, err)
+	}
+	return re, nil
+}
+
+// evalBoolean runs a boolean query on a backend that cannot run it natively.
+// Each pattern is searched separately, then the expression is evaluated on
+// each file or on each line, depending on the scope. Only the results of the
+// patterns that are not negated are returned.
+//
+// With ScopeFile, the value of each pattern is whether the file has results
+// for it. With ScopeLine, only the patterns that are not negated are
+// searched, and the value of each pattern is whether it matches the lines of
+// the result locally.
+func evalBoolean(ctx context.Context, b Backend, q *Query, opts SearchOptions) (iter.Seq2[Result, error], []error) {
+	var (
+		caps     = b.Capabilities()
+		leaves   = q.Bool.leaves()
+		positive = q.Bool.positiveLeaves()
+		warnings []error
+		seen     = make(map[string]struct{})
+		seqs     = make(map[*Expr]iter.Seq2[Result, error])
+	)
+	if len(positive) == 0 {
+		return errorSeq(fmt.Errorf("%w: at least one pattern must not be negated", ErrInvalidQuery)), nil
+	}
+	caseInsensitive := q.caseInsensitive(opts.CaseInsensitive)
+	for _, leaf := range leaves {
+		if opts.Scope == ScopeLine && !positive[leaf] {
+			continue
+		}
+		seq, ws := Emulate(ctx, b, q.leafQuery(leaf), opts)
+		seqs[leaf] = seq
+		for _, w := range ws {
+			if _, ok := seen[w.Error()]; !ok {
+				seen[w.Error()] = struct{}{}
+				warnings = append(warnings, w)
+			}
+		}
+	}
+	return func(yield func(Result, error) bool) {
+		fileKey := func(r *Result) string {
+			return r.Backend + "\x00" + r.RepoURL + "\x00" + r.Path
+		}
+		resultKey := func(r *Result) string {
+			return fmt.Sprintf("%s\x00%d\x00%d", fileKey(r), r.Start.Line, r.End.Line)
+		}
+		// files with results for each pattern
+		files := make(map[*Expr]map[string]bool)
+		// results of the positive patterns, merged by position, and the
+		// patterns that produced them
+		var (
+			candidates []*Result
+			byKey      = make(map[string]*Result)
+			origins    = make(map[*Result]map[*Expr]bool)
+		)
+		for _, leaf := range leaves {
+			seq, ok := seqs[leaf]
+			if !ok {
+				continue
+			}
+			files[leaf] = make(map[string]bool)
+			for res, err := range seq {
+				if err != nil {
+					yield(Result{}, err)
+					return
+				}
+				files[leaf][fileKey(&res)] = true
+				if !positive[leaf] {
+					continue
+				}
+				key := resultKey(&res)
+				cand, ok := byKey[key]
+				if !ok {
+					cand = &res
+					byKey[key] = cand
+					candidates = append(candidates, cand)
+					origins[cand] = make(map[*Expr]bool)
+				} else {
+					for _, hl := range res.Highlights {
+						cand.addHighlight(hl)
+					}
+				}
+				origins[cand][leaf] = true
+			}
+		}
+		matchers := make(map[*Expr]*regexp.Regexp)
+		if opts.Scope == ScopeLine {
+			for _, leaf := range leaves {
+				re, err := leafRegexp(leaf, caps, caseInsensitive, opts.WordRegexp)
+				if err != nil {
+					yield(Result{}, err)
+					return
+				}
+				matchers[leaf] = re
+			}
+		}
+		for _, cand := range candidates {
+			var ok bool
+			if opts.Scope == ScopeLine {
+				text := strings.Join(cand.Lines, "\n")
+				ok = q.Bool.eval(func(leaf *Expr) bool {
+					return origins[cand][leaf] || matchers[leaf].MatchString(text)
+				})
+			} else {
+				key := fileKey(cand)
+				ok = q.Bool.eval(func(leaf *Expr) bool {
+					return files[leaf][key]
+				})
+			}
+			if ok && !yield(*cand, nil) {
+				return
+			}
+		}
+	}, warnings
+}
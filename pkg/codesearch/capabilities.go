@@ -0,0 +1,307 @@
+package codesearch
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// UnlimitedContextLines is the value of Capabilities.MaxContextLines for
+// backends that can return any number of context lines.
+const UnlimitedContextLines = -1
+
+// Capabilities describes the features that a backend supports natively.
+type Capabilities struct {
+	// Regexp is true if the backend can search regular expressions
+	// (PatternRegexp), either natively or by verifying the results of a
+	// literal search client-side.
+	Regexp bool
+	// DefaultRegexp is true if the patterns without an explicit kind
+	// (PatternDefault) are interpreted as regular expressions.
+	DefaultRegexp bool
+	// CaseSensitive is true if the backend can do case-sensitive searches.
+	CaseSensitive bool
+	// CaseInsensitive is true if the backend can do case-insensitive searches.
+	CaseInsensitive bool
+	// SearchInFilenames is true if the backend can search the terms in the
+	// file names rather than in the file content.
+	SearchInFilenames bool
+	// Boolean is true if the backend can run boolean queries that are an AND
+	// of terms and negated terms, or an OR of terms. Other boolean queries
+	// are evaluated client-side.
+	Boolean bool
+	// WordRegexp is true if the backend can restrict the matches to whole
+	// words.
+	WordRegexp bool
+	// Symbols is true if the backend can search the definitions of symbols,
+	// see SearchOptions.Symbol. Other backends search the name as a word, and
+	// the matching lines are filtered with the heuristics of lineSymbols.
+	Symbols bool
+	// MaxContextLines is the maximum number of context lines that the backend
+	// can return before and after a match, or UnlimitedContextLines.
+	MaxContextLines int
+	// Qualifiers are the query qualifiers that the backend translates to its
+	// native query, see QualifierRepo, QualifierPath and QualifierLang.
+	Qualifiers []string
+}
+
+// HasQualifier returns true if the backend supports the given qualifier
+// natively.
+func (c Capabilities) HasQualifier(name string) bool {
+	for _, q := range c.Qualifiers {
+		if q == name {
+			return true
+		}
+	}
+	return false
+}
+
+// termsMatcher returns a regexp that matches the terms of the query with the
+// case sensitivity and word boundaries of the search options, the way the
+// backend interprets them. Backends that don't interpret patterns as regexps
+// search each word separately, unless the pattern is quoted.
+func termsMatcher(q *Query, caps Capabilities, opts SearchOptions) (*regexp.Regexp, error) {
+	leaves := []*Expr{{Op: ExprPattern, Pattern: q.Pattern, Kind: q.Kind}}
+	if q.Bool != nil {
+		leaves = nil
+		positive := q.Bool.positiveLeaves()
+		for _, leaf := range q.Bool.leaves() {
+			if positive[leaf] {
+				leaves = append(leaves, leaf)
+			}
+		}
+	}
+	var alternatives []string
+	for _, leaf := range leaves {
+		switch {
+		case leaf.Kind == PatternRegexp || leaf.Kind == PatternDefault && caps.DefaultRegexp:
+			alternatives = append(alternatives, "(?:"+leaf.Pattern+")")
+		case leaf.Kind == PatternLiteral:
+			alternatives = append(alternatives, regexp.QuoteMeta(leaf.Pattern))
+		default:
+			for _, word := range strings.Fields(leaf.Pattern) {
+				alternatives = append(alternatives, regexp.QuoteMeta(word))
+			}
+		}
+	}
+	pattern := strings.Join(alternatives, "|")
+	if opts.WordRegexp {
+		pattern = wordPattern(pattern)
+	}
+	if opts.CaseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidQuery, err)
+	}
+	return re, nil
+}
+
+// emulation describes how a search runs on a backend: the query and the
+// options actually passed to it, and the filters applied to its results.
+type emulation struct {
+	q        *Query
+	opts     SearchOptions
+	filters  []resultFilter
+	warnings []error
+}
+
+// resultFilter modifies a result in place, and returns false if the result
+// must be dropped. desc describes it for Explain.
+type resultFilter struct {
+	desc string
+	fn   func(*Result) bool
+}
+
+// Emulate runs a search on the backend, adapting the search options to the
+// backend's capabilities. Options that are not supported natively are emulated
+// by post-filtering the results where possible. The returned warnings wrap
+// ErrUnsupported, and describe the options that cannot be fully honored.
+func Emulate(ctx context.Context, b Backend, q *Query, opts SearchOptions) (iter.Seq2[Result, error], []error) {
+	if needsBooleanEval(b, q, opts) {
+		return evalBoolean(ctx, b, q, opts)
+	}
+	e, err := planEmulation(b, q, opts)
+	if err != nil {
+		return errorSeq(err), nil
+	}
+	results := b.Search(ctx, e.q, e.opts)
+	return func(yield func(Result, error) bool) {
+	next:
+		for res, err := range results {
+			if err != nil {
+				yield(res, err)
+				return
+			}
+			for _, filter := range e.filters {
+				if !filter.fn(&res) {
+					continue next
+				}
+			}
+			if !yield(res, nil) {
+				return
+			}
+		}
+	}, e.warnings
+}
+
+// needsBooleanEval returns true if the query is a boolean query that the
+// backend cannot run natively, see evalBoolean.
+func needsBooleanEval(b Backend, q *Query, opts SearchOptions) bool {
+	return q.Bool != nil && (!b.Capabilities().Boolean || opts.Scope != ScopeFile || !q.Bool.isFlat())
+}
+
+// planEmulation computes the query, the options and the filters to search
+// with on the backend.
+func planEmulation(b Backend, q *Query, opts SearchOptions) (*emulation, error) {
+	var (
+		caps  = b.Capabilities()
+		e     emulation
+		terms = q.terms()
+	)
+	addFilter := func(desc string, fn func(*Result) bool) {
+		e.filters = append(e.filters, resultFilter{desc: desc, fn: fn})
+	}
+	opts.CaseInsensitive = q.caseInsensitive(opts.CaseInsensitive)
+	if q.Kind == PatternRegexp && !caps.Regexp {
+		e.warnings = append(e.warnings, fmt.Errorf("%w: regexp search, searching the pattern as literal text", ErrUnsupported))
+		nq := *q
+		nq.Kind = PatternLiteral
+		q = &nq
+	}
+	// search the name of the symbol as a word, and recognize the
+	// definitions among the returned lines
+	emulateSymbol := opts.Symbol && !caps.Symbols
+	if emulateSymbol {
+		opts.Symbol = false
+		opts.WordRegexp = true
+		e.warnings = append(e.warnings, fmt.Errorf("%w: symbol search, only the definitions that fit on the returned lines are found", ErrUnsupported))
+	}
+	// detect the language of the results that the backend didn't set, from
+	// the file name
+	addFilter("", func(res *Result) bool {
+		if res.Language == "" {
+			res.Language = DetectLanguage(res.Path, "")
+		}
+		return true
+	})
+	// apply the qualifiers that the backend can't express client-side
+	var clientSide Query
+	if !caps.HasQualifier(QualifierRepo) {
+		clientSide.Repos = q.Repos
+	}
+	if !caps.HasQualifier(QualifierPath) {
+		clientSide.Paths = q.Paths
+	}
+	if !caps.HasQualifier(QualifierLang) {
+		clientSide.Langs = q.Langs
+	}
+	if len(clientSide.Repos) > 0 || len(clientSide.Paths) > 0 || len(clientSide.Langs) > 0 {
+		addFilter("qualifiers "+clientSide.qualifiersString(), clientSide.MatchResult)
+	}
+	// backends may push the globs down to their native query, but the
+	// result is not always exact, so they are always enforced here
+	pathFilter, err := NewPathFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if !pathFilter.IsEmpty() {
+		addFilter(fmt.Sprintf("path globs, include %q, exclude %q", opts.Include, opts.Exclude), func(res *Result) bool {
+			return pathFilter.Match(res.Path)
+		})
+	}
+	if opts.CaseInsensitive && !caps.CaseInsensitive {
+		e.warnings = append(e.warnings, fmt.Errorf("%w: case-insensitive search, searching case-sensitively", ErrUnsupported))
+	}
+	// regexps are matched locally with the requested case sensitivity and
+	// word boundaries, see literalQuery
+	caseMismatch := !opts.CaseInsensitive && !caps.CaseSensitive
+	wordMismatch := opts.WordRegexp && !caps.WordRegexp
+	if (caseMismatch || wordMismatch) && q.Kind != PatternRegexp {
+		// the backend matches case-insensitively or ignores word
+		// boundaries, so match the terms again on the lines of each result,
+		// recompute the highlights, and only keep the results that still
+		// have at least one
+		re, err := termsMatcher(q, caps, opts)
+		if err != nil {
+			return nil, err
+		}
+		addFilter(fmt.Sprintf("match %q again on the returned lines, and recompute the highlights", re), func(res *Result) bool {
+			if res.IsFilename || len(res.Lines) == 0 {
+				return true
+			}
+			var highlights []Range
+			for idx, line := range res.Lines {
+				for _, loc := range re.FindAllStringIndex(line, -1) {
+					highlights = append(highlights, Range{Line: idx, Start: loc[0], End: loc[1]})
+				}
+			}
+			res.Highlights = highlights
+			res.updateColumns()
+			return len(highlights) > 0
+		})
+	}
+	if emulateSymbol {
+		re, err := symbolMatcher(q, caps, opts)
+		if err != nil {
+			return nil, err
+		}
+		addFilter(fmt.Sprintf("keep the lines that define a symbol matching %q, recognized with heuristics", re), func(res *Result) bool {
+			if res.IsFilename {
+				return false
+			}
+			var highlights []Range
+			for idx, line := range res.Lines {
+				for _, sym := range lineSymbols(res.Language, line) {
+					if !re.MatchString(sym.Name) {
+						continue
+					}
+					if res.SymbolKind == "" {
+						res.SymbolKind = sym.Kind
+					}
+					highlights = append(highlights, Range{Line: idx, Start: sym.Column - 1, End: sym.Column - 1 + len(sym.Name)})
+				}
+			}
+			res.Highlights = highlights
+			res.updateColumns()
+			return len(highlights) > 0
+		})
+	}
+	if opts.SearchInFilenames && !caps.SearchInFilenames {
+		// search the content and keep the files whose name matches. Files
+		// whose content doesn't match the terms cannot be found this way.
+		opts.SearchInFilenames = false
+		e.warnings = append(e.warnings, fmt.Errorf("%w: search in file names, only files whose content matches will be found", ErrUnsupported))
+		seen := make(map[string]struct{})
+		addFilter(fmt.Sprintf("search the content, and keep the files whose name contains %q", terms), func(res *Result) bool {
+			name := path.Base(res.Path)
+			if opts.CaseInsensitive || !caps.CaseSensitive {
+				if !strings.Contains(strings.ToLower(name), strings.ToLower(terms)) {
+					return false
+				}
+			} else if !strings.Contains(name, terms) {
+				return false
+			}
+			key := res.RepoURL + "/" + res.Path
+			if _, ok := seen[key]; ok {
+				return false
+			}
+			seen[key] = struct{}{}
+			*res = res.filenameResult()
+			return true
+		})
+	}
+	if maxLines := caps.MaxContextLines; maxLines != UnlimitedContextLines {
+		if opts.LinesBefore > maxLines || opts.LinesAfter > maxLines {
+			e.warnings = append(e.warnings, fmt.Errorf("%w: more than %d context lines", ErrUnsupported, maxLines))
+		}
+		opts.LinesBefore = min(opts.LinesBefore, maxLines)
+		opts.LinesAfter = min(opts.LinesAfter, maxLines)
+	}
+	e.q, e.opts = q, opts
+	return &e, nil
+}
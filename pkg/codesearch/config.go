@@ -1,15 +1,119 @@
 package codesearch
 
-import "fmt"
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	DefaultBackends []string                 `mapstructure:"default_backends"`
 	Backends        map[string]BackendConfig `mapstructure:"backends"`
+	// DefaultExcludes are globs of paths that are never searched, e.g.
+	// "vendor/**". They are applied before the excludes of each request, so
+	// a request can include them again with a negated glob.
+	DefaultExcludes []string `mapstructure:"default_excludes"`
+	// SavedSearches are named searches, that can be run with
+	// "cs search @name".
+	SavedSearches map[string]SavedSearch `mapstructure:"saved_searches"`
+	// Templates are named text/template output formats, that can be used
+	// with "cs search --template name".
+	Templates map[string]string `mapstructure:"templates"`
+}
+
+// SavedSearch is a named search in the configuration file. Its query can
+// refer to parameters as ${name}, which are replaced by Expand. Any other $ is
+// left as is, e.g. in regexps. The names of the parameters are
+// case-insensitive, because the configuration file loader lowercases the keys
+// of Params.
+type SavedSearch struct {
+	Description string `mapstructure:"description"`
+	// Query is the query in the syntax accepted by ParseQuery.
+	Query string `mapstructure:"query"`
+	// Params are the default values of the parameters of the query.
+	Params map[string]string `mapstructure:"params"`
+	// Backends are the names of the backends to search, instead of
+	// default_backends.
+	Backends        []string `mapstructure:"backends"`
+	Langs           []string `mapstructure:"lang"`
+	Include         []string `mapstructure:"include"`
+	Exclude         []string `mapstructure:"exclude"`
+	CaseInsensitive bool     `mapstructure:"case_insensitive"`
+	LinesBefore     int      `mapstructure:"before"`
+	LinesAfter      int      `mapstructure:"after"`
+}
+
+// paramRef matches a reference to a parameter of a saved search, ${name}.
+var paramRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandParams replaces the ${name} references in s by mapping(name).
+func expandParams(s string, mapping func(name string) string) string {
+	return paramRef.ReplaceAllStringFunc(s, func(ref string) string {
+		return mapping(ref[2 : len(ref)-1])
+	})
+}
+
+// Parameters returns the names of the parameters used in the query, in order
+// of appearance. The names are lowercase.
+func (s *SavedSearch) Parameters() []string {
+	var names []string
+	seen := make(map[string]struct{})
+	expandParams(s.Query, func(name string) string {
+		name = strings.ToLower(name)
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+		return ""
+	})
+	return names
+}
+
+// Expand returns the query with the parameters replaced by their values in
+// args, or by their default values. It fails if a parameter has no value.
+func (s *SavedSearch) Expand(args map[string]string) (string, error) {
+	params := s.Parameters()
+	values := make(map[string]string, len(args))
+	for name, value := range args {
+		key := strings.ToLower(name)
+		if !slices.Contains(params, key) {
+			return "", fmt.Errorf("%w: unknown parameter %q", ErrInvalidQuery, name)
+		}
+		if _, ok := values[key]; ok {
+			return "", fmt.Errorf("%w: duplicate parameter %q", ErrInvalidQuery, name)
+		}
+		values[key] = value
+	}
+	defaults := make(map[string]string, len(s.Params))
+	for name, value := range s.Params {
+		defaults[strings.ToLower(name)] = value
+	}
+	var missing []string
+	query := expandParams(s.Query, func(name string) string {
+		name = strings.ToLower(name)
+		if value, ok := values[name]; ok {
+			return value
+		}
+		if value, ok := defaults[name]; ok {
+			return value
+		}
+		missing = append(missing, name)
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w: missing value for parameters %q", ErrInvalidQuery, missing)
+	}
+	return query, nil
 }
 
 type BackendConfig struct {
 	Type   BackendType   `mapstructure:"type"`
 	Params BackendParams `mapstructure:"params"`
+	// Timeout is the maximum duration of a search on this backend. Zero means
+	// no timeout.
+	Timeout time.Duration `mapstructure:"timeout"`
 }
 
 type BackendParams map[string]interface{}
@@ -32,31 +136,29 @@ func (b *BackendParams) GetString(name string) *string {
 	return &s
 }
 
+func (b *BackendParams) GetBool(name string) *bool {
+	p := map[string]interface{}(*b)
+	bp, ok := p[name]
+	if !ok {
+		return nil
+	}
+	v, ok := bp.(bool)
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
 type BackendType string
 
+// Built-in backend types. Other backend types can be added with
+// RegisterBackend.
 const (
-	BackendTypeGithub    = "github"
-	BackendTypeGitlab    = "gitlab"
-	BackendTypeBitbucket = "bitbucket"
-	BackendTypeCsearch   = "csearch"
-	BackendTypeUnknown   = "unknown"
+	BackendTypeGithub  BackendType = "github"
+	BackendTypeGitlab  BackendType = "gitlab"
+	BackendTypeCsearch BackendType = "csearch"
 )
 
-func BackendTypeByName(name string) BackendType {
-	switch name {
-	case string(BackendTypeGithub):
-		return BackendTypeGithub
-	case string(BackendTypeGitlab):
-		return BackendTypeGitlab
-	case string(BackendTypeBitbucket):
-		return BackendTypeBitbucket
-	case string(BackendTypeCsearch):
-		return BackendTypeCsearch
-	default:
-		return BackendTypeUnknown
-	}
-}
-
 func (c *Config) Validate() error {
 	// ensure that default_backends is either "all" or a list of backend names
 	for _, name := range c.DefaultBackends {
@@ -81,9 +183,33 @@ func (c *Config) Validate() error {
 		if name == "all" {
 			return fmt.Errorf("backend name 'all' is reserved")
 		}
-		if BackendTypeByName(string(backend.Type)) == BackendTypeUnknown {
+		if !IsRegistered(backend.Type) {
 			return fmt.Errorf("unknown backend type %q", backend.Type)
 		}
+		if backend.Timeout < 0 {
+			return fmt.Errorf("backend %q: timeout cannot be negative", name)
+		}
+	}
+	if _, err := NewPathFilter(nil, c.DefaultExcludes); err != nil {
+		return fmt.Errorf("default_excludes: %w", err)
+	}
+	for name, saved := range c.SavedSearches {
+		if saved.Query == "" {
+			return fmt.Errorf("saved search %q: missing query", name)
+		}
+		for _, backend := range saved.Backends {
+			if _, ok := c.Backends[backend]; !ok && backend != "all" {
+				return fmt.Errorf("saved search %q: unknown backend %q", name, backend)
+			}
+		}
+		if _, err := NewPathFilter(saved.Include, saved.Exclude); err != nil {
+			return fmt.Errorf("saved search %q: %w", name, err)
+		}
+		for _, lang := range saved.Langs {
+			if LookupLanguage(lang) == nil {
+				return fmt.Errorf("saved search %q: unknown language %q", name, lang)
+			}
+		}
 	}
 	return nil
 }
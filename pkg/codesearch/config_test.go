@@ -0,0 +1,56 @@
+package codesearch
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSavedSearchExpand(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		query   string
+		params  map[string]string
+		args    map[string]string
+		want    string
+		wantErr error
+	}{
+		{name: "no parameters", query: `/\$password/ lang:go`, want: `/\$password/ lang:go`},
+		{name: "argument", query: `foo lang:${lang}`, args: map[string]string{"lang": "python"}, want: `foo lang:python`},
+		{name: "default", query: `foo lang:${lang}`, params: map[string]string{"lang": "go"}, want: `foo lang:go`},
+		{name: "argument over default", query: `foo lang:${lang}`, params: map[string]string{"lang": "go"}, args: map[string]string{"lang": "c"}, want: `foo lang:c`},
+		{name: "repeated", query: `${x} OR ${x}y`, args: map[string]string{"x": "a"}, want: `a OR ay`},
+		{name: "empty value", query: `foo${x}`, args: map[string]string{"x": ""}, want: `foo`},
+		// the configuration file loader lowercases the keys of params
+		{name: "mixed case reference", query: `${Name} repo:${REPO}`, params: map[string]string{"name": "foo", "repo": "bar"}, want: `foo repo:bar`},
+		{name: "mixed case default", query: `${name}`, params: map[string]string{"Name": "foo"}, want: `foo`},
+		{name: "mixed case argument", query: `${Name}`, args: map[string]string{"NAME": "foo"}, want: `foo`},
+		{name: "missing", query: `${a} ${b}`, args: map[string]string{"a": "x"}, wantErr: ErrInvalidQuery},
+		{name: "unknown", query: `${a}`, args: map[string]string{"a": "x", "b": "y"}, wantErr: ErrInvalidQuery},
+		{name: "duplicate", query: `${a}`, args: map[string]string{"a": "x", "A": "y"}, wantErr: ErrInvalidQuery},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := SavedSearch{Query: tt.query, Params: tt.params}
+			got, err := s.Expand(tt.args)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expand(%q) error = %v, want %v", tt.args, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expand(%q) failed: %v", tt.args, err)
+			}
+			if got != tt.want {
+				t.Errorf("Expand(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSavedSearchParameters(t *testing.T) {
+	s := SavedSearch{Query: `${b} ${Name} $a ${a} ${NAME} ${1x} ${b}`}
+	if got, want := s.Parameters(), []string{"b", "name", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Parameters() = %q, want %q", got, want)
+	}
+}
@@ -1,12 +1,15 @@
 package codesearch
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"iter"
+	"net/url"
 	"os"
 	"path/filepath"
 	goregexp "regexp"
-	"strconv"
 	"strings"
 
 	"github.com/google/codesearch/index"
@@ -15,25 +18,26 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+func init() {
+	RegisterBackend(BackendTypeCsearch, NewCsearch)
+}
+
 // Csearch implements the Backend interface
 type Csearch struct {
-	name              string
-	indexFile         string
-	linesBefore       int
-	linesAfter        int
-	caseInsensitive   bool
-	searchInFilenames bool
+	name      string
+	indexFile string
 }
 
-func (g *Csearch) New(name string, params BackendParams) (Backend, error) {
+// NewCsearch creates a Csearch backend from its configuration parameters.
+func NewCsearch(name string, params BackendParams) (Backend, error) {
 	indexFile := params.GetString("index_file")
 	if indexFile == nil {
-		return nil, fmt.Errorf("missing 'index_file' parameter")
+		return nil, fmt.Errorf("%w: missing 'index_file' parameter", ErrInvalidConfig)
 	}
 	var err error
 	*indexFile, err = homedir.Expand(*indexFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to expand path %q: %v", indexFile, err)
+		return nil, fmt.Errorf("%w: failed to expand path %q: %w", ErrInvalidConfig, *indexFile, err)
 	}
 	gl := Csearch{
 		name:      name,
@@ -46,24 +50,22 @@ func (g *Csearch) Name() string {
 	return g.name
 }
 
-func (g *Csearch) Type() string {
+func (g *Csearch) Type() BackendType {
 	return BackendTypeCsearch
 }
 
-func (g *Csearch) SetCaseInsensitive(v bool) {
-	g.caseInsensitive = v
-}
-
-func (g *Csearch) SetLinesBefore(n int) {
-	g.linesBefore = n
-}
-
-func (g *Csearch) SetLinesAfter(n int) {
-	g.linesAfter = n
-}
-
-func (g *Csearch) SetSearchInFilenames(v bool) {
-	g.searchInFilenames = v
+func (g *Csearch) Capabilities() Capabilities {
+	return Capabilities{
+		Regexp:            true,
+		DefaultRegexp:     true,
+		CaseSensitive:     true,
+		CaseInsensitive:   true,
+		WordRegexp:        true,
+		SearchInFilenames: true,
+		Symbols:           true,
+		MaxContextLines:   UnlimitedContextLines,
+		Qualifiers:        []string{QualifierRepo, QualifierPath, QualifierLang},
+	}
 }
 
 func removePathPrefix(s, prefix string) string {
@@ -74,167 +76,247 @@ func removePathPrefix(s, prefix string) string {
 	return s
 }
 
-func (g *Csearch) Search(searchString string, opts ...Opt) (Results, error) {
-	for _, opt := range opts {
-		opt(g)
+// nativePattern translates the pattern of a query to a regular expression.
+func (g *Csearch) nativePattern(q *Query) string {
+	if q.Kind == PatternLiteral {
+		return goregexp.QuoteMeta(q.Pattern)
 	}
-	pattern := "(?m)" + searchString
-	if g.caseInsensitive {
+	return q.Pattern
+}
+
+// pattern returns the regexp to search, with the flags for the options.
+func (g *Csearch) pattern(q *Query, opts SearchOptions) string {
+	pattern := g.nativePattern(q)
+	if opts.WordRegexp {
+		pattern = wordPattern(pattern)
+	}
+	pattern = "(?m)" + pattern
+	if opts.CaseInsensitive {
 		pattern = "(?i)" + pattern
 	}
-	ix := index.Open(g.indexFile)
-	if g.searchInFilenames {
-		// get all the file names instead of doing a search on the cindex
-		logrus.Debugf("Searching in file names")
-		re, err := goregexp.Compile(pattern)
+	return pattern
+}
+
+// openIndex opens the index file.
+func (g *Csearch) openIndex() (*index.Index, error) {
+	// index.Open exits the program if the index cannot be opened, so check
+	// that it exists first
+	if _, err := os.Stat(g.indexFile); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("%w: %w", ErrIndexMissing, err)
+		}
+		return nil, fmt.Errorf("cannot open index: %w", err)
+	}
+	return index.Open(g.indexFile), nil
+}
+
+// Explain describes how the query is searched in the index, with the trigram
+// query and the number of candidate files that it selects.
+func (g *Csearch) Explain(ctx context.Context, q *Query, opts SearchOptions) (*Plan, error) {
+	pattern := g.pattern(q, opts)
+	ix, err := g.openIndex()
+	if err != nil {
+		return nil, err
+	}
+	all := ix.PostingQuery(&index.Query{Op: index.QAll})
+	plan := Plan{Native: []string{"regexp " + pattern}}
+	if opts.SearchInFilenames {
+		plan.Native = append(plan.Native, fmt.Sprintf("match the names of the files in the %d indexed paths", len(ix.Paths())))
+		return &plan, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to compile regexp pattern: %w", ErrInvalidQuery, err)
+	}
+	iq := index.RegexpQuery(re.Syntax)
+	post := ix.PostingQuery(iq)
+	plan.Native = append(plan.Native, "index query "+iq.String())
+	if len(q.Repos) > 0 || len(q.Paths) > 0 || len(q.Langs) > 0 || len(opts.Include) > 0 || len(opts.Exclude) > 0 {
+		plan.Native = append(plan.Native, "filter the candidate files by name with the qualifiers and the path globs")
+	}
+	if opts.Symbol {
+		symbolRe, err := symbolMatcher(q, g.Capabilities(), opts)
 		if err != nil {
-			return nil, fmt.Errorf("failed to compile pattern for indexing: %w", err)
+			return nil, err
 		}
-		var results Results
-		for _, indexedPath := range ix.Paths() {
-			files := make(map[string]struct{})
-			err = filepath.Walk(indexedPath, func(path string, info os.FileInfo, err error) error {
-				shortName := removePathPrefix(info.Name(), path)
-				if err == nil && re.MatchString(shortName) {
-					logrus.Debugf("Adding file %s", path)
-					files[path] = struct{}{}
-				}
-				return nil
-			})
+		plan.Native = append(plan.Native, fmt.Sprintf("extract the symbols of the candidate files, with go/parser for Go and heuristics for the other languages, and keep the definitions matching %q", symbolRe))
+	}
+	plan.Estimate = append(plan.Estimate, fmt.Sprintf("%d candidate files out of %d indexed files, read and matched with the regexp", len(post), len(all)))
+	return &plan, nil
+}
+
+func (g *Csearch) Search(ctx context.Context, q *Query, opts SearchOptions) iter.Seq2[Result, error] {
+	return func(yield func(Result, error) bool) {
+		pattern := g.pattern(q, opts)
+		pathFilter, err := NewPathFilter(opts.Include, opts.Exclude)
+		if err != nil {
+			yield(Result{}, err)
+			return
+		}
+		ix, err := g.openIndex()
+		if err != nil {
+			yield(Result{}, err)
+			return
+		}
+		if opts.SearchInFilenames {
+			// get all the file names instead of doing a search on the cindex
+			logrus.Debugf("Searching in file names")
+			re, err := goregexp.Compile(pattern)
 			if err != nil {
-				return nil, fmt.Errorf("failed to walk the source tree: %w", err)
+				yield(Result{}, fmt.Errorf("%w: failed to compile pattern for indexing: %w", ErrInvalidQuery, err))
+				return
 			}
-			for path := range files {
-				shortName := removePathPrefix(path, indexedPath)
-				logrus.Debugf("indexPath=%s path=%s shortName=%s", indexedPath, path, shortName)
-				result := Result{
-					Backend:    g.Name(),
-					Path:       shortName,
-					RepoURL:    "file://" + indexedPath,
-					FileURL:    "file://" + path,
-					Owner:      "",
-					RepoName:   indexedPath,
-					IsFilename: true,
+			for _, indexedPath := range ix.Paths() {
+				if !q.MatchRepo("", indexedPath) {
+					continue
+				}
+				stopped := false
+				err = filepath.Walk(indexedPath, func(path string, info os.FileInfo, err error) error {
+					if ctxErr := ctx.Err(); ctxErr != nil {
+						return ctxErr
+					}
+					if err != nil {
+						return nil
+					}
+					shortName := removePathPrefix(info.Name(), path)
+					if !re.MatchString(shortName) {
+						return nil
+					}
+					shortName = removePathPrefix(path, indexedPath)
+					if !q.MatchPath(shortName) {
+						return nil
+					}
+					logrus.Debugf("indexPath=%s path=%s shortName=%s", indexedPath, path, shortName)
+					result := Result{
+						Backend:    g.Name(),
+						Path:       shortName,
+						RepoURL:    fileURL(indexedPath),
+						FileURL:    fileURL(path),
+						Owner:      "",
+						RepoName:   indexedPath,
+						IsFilename: true,
+					}
+					if !yield(result, nil) {
+						stopped = true
+						return filepath.SkipAll
+					}
+					return nil
+				})
+				if stopped {
+					return
+				}
+				if err != nil {
+					yield(Result{}, fmt.Errorf("failed to walk the source tree: %w", err))
+					return
 				}
-				results = append(results, result)
 			}
+			return
 		}
-		return results, nil
-	}
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return nil, fmt.Errorf("failed to compile regexp pattern: %w", err)
-	}
-	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
-	grep := regexp.Grep{
-		Stdout: &stdout,
-		Stderr: &stderr,
-		Regexp: re,
-		N:      true, // need lineno
-		H:      true, // do not print file names
-	}
-	q := index.RegexpQuery(re.Syntax)
-	post := ix.PostingQuery(q)
-	return g.toResult(pattern, ix, grep, post)
-}
-
-func (g *Csearch) toResult(pattern string, ix *index.Index, grep regexp.Grep, post []uint32) (Results, error) {
-	var results Results
-	re, err := goregexp.Compile(pattern)
-	if err != nil {
-		return nil, fmt.Errorf("failed to compile pattern for indexing: %w", err)
-	}
-	for _, fileid := range post {
-		name := ix.Name(fileid)
-		logrus.Debugf("fileid=%d name=%q", fileid, name)
-		grep.File(name)
-		b := grep.Stdout.(*bytes.Buffer)
-		o := b.String()
-		b.Reset()
-		if o == "" {
-			e := grep.Stderr.(*bytes.Buffer).String()
-			if e != "" {
-				return nil, fmt.Errorf("match reader failed: %s", e)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			yield(Result{}, fmt.Errorf("%w: failed to compile regexp pattern: %w", ErrInvalidQuery, err))
+			return
+		}
+		// the index query only selects the candidate files, the matches are
+		// then located with the standard library's regexp, which can match
+		// across lines
+		hlre, err := goregexp.Compile(pattern)
+		if err != nil {
+			yield(Result{}, fmt.Errorf("%w: failed to compile pattern for matching: %w", ErrInvalidQuery, err))
+			return
+		}
+		// for symbol searches, the index query selects the files that
+		// contain the name, and the definitions are found by extracting the
+		// symbols of each file
+		var symbolRe *goregexp.Regexp
+		if opts.Symbol {
+			symbolRe, err = symbolMatcher(q, g.Capabilities(), opts)
+			if err != nil {
+				yield(Result{}, err)
+				return
 			}
-			// no output, no error, just continue
-			logrus.Debugf("Skipping empty file results")
-			continue
 		}
-		olines := strings.Split(o, "\n")
-		for _, oline := range olines {
-			if oline == "" {
-				// skip empty lines reulting from the newline split
+		post := ix.PostingQuery(index.RegexpQuery(re.Syntax))
+		// match one file at a time, emitting its results before moving on to
+		// the next one
+		for _, fileid := range post {
+			if err := ctx.Err(); err != nil {
+				yield(Result{}, fmt.Errorf("search interrupted: %w", err))
+				return
+			}
+			name := ix.Name(fileid)
+			logrus.Debugf("fileid=%d name=%q", fileid, name)
+			indexedPath := indexedPathOf(ix, name)
+			if indexedPath == "" {
+				yield(Result{}, fmt.Errorf("no indexed path found for %q", name))
+				return
+			}
+			// apply the qualifiers and the globs before reading the file. The
+			// language of files without a known name or extension is
+			// detected from their content
+			shortName := removePathPrefix(name, indexedPath)
+			if !q.MatchRepo("", indexedPath) || !q.matchPaths(shortName) || !pathFilter.Match(shortName) {
 				continue
 			}
-			parts := strings.SplitN(oline, ":", 2)
-			if len(parts) < 2 {
-				return nil, fmt.Errorf("malformed result line: has fewer than 2 components. Line: %q", oline)
+			lang := DetectLanguage(shortName, "")
+			if lang != "" && !q.MatchLang(lang) {
+				continue
 			}
-			lineno64, err := strconv.ParseInt(parts[0], 10, 64)
+			content, err := os.ReadFile(name)
 			if err != nil {
-				return nil, fmt.Errorf("invalid line number: %w", err)
+				yield(Result{}, fmt.Errorf("failed to read file %q: %w", name, err))
+				return
 			}
-			lineno := int(lineno64)
-			line := parts[1]
-			newlineIdx := strings.Index(line, "\n")
-			if newlineIdx != -1 {
-				line = line[:newlineIdx]
-			}
-			// find indexed path
-			var indexedPath string
-			for _, p := range ix.Paths() {
-				if strings.HasPrefix(name, p) {
-					indexedPath = p
-					break
+			if lang == "" {
+				lang = DetectLanguage(shortName, string(content))
+				if !q.MatchLang(lang) {
+					continue
 				}
 			}
-			if indexedPath == "" {
-				return nil, fmt.Errorf("no indexed path found for %q", name)
+			var results Results
+			if symbolRe != nil {
+				results = matchSymbols(string(content), ExtractSymbols(shortName, string(content)), symbolRe, opts)
+			} else {
+				results = matchContent(string(content), hlre, opts)
 			}
-			var before, after []string
-			if g.linesBefore > 0 || g.linesAfter > 0 {
-				fullText, err := os.ReadFile(name)
-				if err != nil {
-					return nil, fmt.Errorf("failed to read file %q: %w", name, err)
-				}
-				lines := strings.Split(string(fullText), "\n")
-				indexBefore := lineno - g.linesBefore
-				if indexBefore < 0 {
-					indexBefore = 0
-				}
-				indexAfter := lineno + g.linesAfter
-				if indexAfter > len(lines) {
-					indexAfter = len(lines)
+			results = g.toResult(results, indexedPath, name, lang)
+			for _, result := range results {
+				if !yield(result, nil) {
+					return
 				}
-				before = lines[indexBefore:lineno]
-				after = lines[lineno+1 : indexAfter+1]
 			}
-			// find start and end offsets for highlight
-			offsets := re.FindAllStringIndex(line, -1)
-			// TODO use the offsets after the first one, once multiple highlight
-			// support is added to the Backend interface
-			var start, end int
-			if len(offsets) > 0 {
-				start, end = offsets[0][0], offsets[0][1]
-			}
-			shortName := removePathPrefix(name, indexedPath)
-			result := Result{
-				Backend:   g.Name(),
-				Path:      shortName,
-				RepoURL:   "file://" + indexedPath,
-				FileURL:   "file://" + name,
-				Owner:     "",
-				RepoName:  indexedPath,
-				Branch:    "",
-				Context:   ResultContext{Before: before, After: after},
-				Lineno:    lineno,
-				Line:      line,
-				Highlight: [2]int{start, end},
-				// TODO: IsFilename
-				//IsFilename: true/false
-			}
-			results = append(results, result)
 		}
 	}
-	return results, nil
+}
+
+// fileURL returns the file:// URL of a local path, escaped so that names
+// with characters like # or ? can be parsed back.
+func fileURL(p string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(p)}).String()
+}
+
+// toResult fills in the fields that describe the file in the matches of the
+// given file, and returns them.
+func (g *Csearch) toResult(results Results, indexedPath, name, lang string) Results {
+	shortName := removePathPrefix(name, indexedPath)
+	for idx := range results {
+		results[idx].Backend = g.Name()
+		results[idx].Path = shortName
+		results[idx].RepoURL = fileURL(indexedPath)
+		results[idx].FileURL = fileURL(name)
+		results[idx].RepoName = indexedPath
+		results[idx].Language = lang
+	}
+	return results
+}
+
+// indexedPathOf returns the indexed path that contains the given file name, or
+// an empty string if there is none.
+func indexedPathOf(ix *index.Index, name string) string {
+	for _, p := range ix.Paths() {
+		if strings.HasPrefix(name, p) {
+			return p
+		}
+	}
+	return ""
 }
@@ -0,0 +1,70 @@
+package codesearch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned by the backends and the Searcher. They are wrapped with
+// more context, so use errors.Is to check for them.
+var (
+	// ErrInvalidConfig is returned when a backend's configuration is
+	// missing required parameters or has invalid ones.
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrInvalidQuery is returned when the search terms cannot be parsed.
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrUnauthorized is returned when the backend rejects the credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound is returned when a resource, such as a GitLab group or
+	// project, does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrRateLimited is returned when the backend's rate limit is exceeded.
+	// The error is a *RateLimitError, which carries the reset time.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrUnsupported is used for the search options that a backend does not
+	// support and that cannot be emulated.
+	ErrUnsupported = errors.New("unsupported feature")
+	// ErrIndexMissing is returned when a local index file does not exist.
+	ErrIndexMissing = errors.New("index missing")
+)
+
+// RateLimitError is returned when the rate limit of a backend is exceeded and
+// the search cannot wait for it to reset. It matches ErrRateLimited.
+type RateLimitError struct {
+	// Reset is the time when the rate limit resets, or the zero time if
+	// unknown.
+	Reset time.Time
+	Err   error
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Reset.IsZero() {
+		return fmt.Sprintf("%s: %v", ErrRateLimited, e.Err)
+	}
+	return fmt.Sprintf("%s until %s: %v", ErrRateLimited, e.Reset.Format(time.RFC3339), e.Err)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// httpStatusError maps an HTTP status code returned by a backend's API to one
+// of the errors above, wrapping err. Status codes without a matching error
+// return err unchanged.
+func httpStatusError(status int, err error) error {
+	switch status {
+	case 401, 403:
+		return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	case 404:
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case 429:
+		return &RateLimitError{Err: err}
+	default:
+		return err
+	}
+}
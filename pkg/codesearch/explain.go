@@ -0,0 +1,89 @@
+package codesearch
+
+import (
+	"context"
+	"fmt"
+)
+
+// Plan describes how a query runs on a backend, see Explain.
+type Plan struct {
+	Backend string
+	Type    BackendType
+	// Query is the query passed to the backend, after adapting it to the
+	// backend's capabilities.
+	Query string
+	// Native describes what is sent to the backend, in its own syntax, e.g.
+	// the query string of a search API or the regexp of an index query.
+	Native []string
+	// ClientSide describes the work done on the results of the backend, e.g.
+	// filters for the options that the backend does not support natively.
+	ClientSide []string
+	// Estimate describes the cost of the search, e.g. the number of API calls
+	// or the number of candidate files.
+	Estimate []string
+	// Warnings describes the search options that cannot be fully honored,
+	// see Emulate.
+	Warnings []error
+	// Patterns has the plans of the patterns of a boolean query that is
+	// evaluated client-side, see evalBoolean.
+	Patterns []*Plan
+	// Err is the error that prevented explaining the search, if any.
+	Err error
+}
+
+// Explainer is implemented by the backends that can describe how they run a
+// query natively.
+type Explainer interface {
+	// Explain describes how the backend runs the query, with the options
+	// already adapted by Emulate. It may contact the backend, e.g. to
+	// estimate the number of results.
+	Explain(ctx context.Context, q *Query, opts SearchOptions) (*Plan, error)
+}
+
+// Explain describes how Emulate runs a query on a backend, without running
+// the search. The native part of the plan is only detailed for the backends
+// that implement Explainer.
+func Explain(ctx context.Context, b Backend, q *Query, opts SearchOptions) (*Plan, error) {
+	if needsBooleanEval(b, q, opts) {
+		plan := Plan{Backend: b.Name(), Type: b.Type(), Query: q.String()}
+		positive := q.Bool.positiveLeaves()
+		if len(positive) == 0 {
+			return nil, fmt.Errorf("%w: at least one pattern must not be negated", ErrInvalidQuery)
+		}
+		if opts.Scope == ScopeLine {
+			plan.ClientSide = append(plan.ClientSide, fmt.Sprintf("search the patterns that are not negated, then evaluate %s on each line of their results", q.Bool))
+		} else {
+			plan.ClientSide = append(plan.ClientSide, fmt.Sprintf("search each pattern separately, then evaluate %s on each file", q.Bool))
+		}
+		for _, leaf := range q.Bool.leaves() {
+			if opts.Scope == ScopeLine && !positive[leaf] {
+				continue
+			}
+			sub, err := Explain(ctx, b, q.leafQuery(leaf), opts)
+			if err != nil {
+				return nil, err
+			}
+			plan.Patterns = append(plan.Patterns, sub)
+		}
+		return &plan, nil
+	}
+	e, err := planEmulation(b, q, opts)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Native: []string{"query " + e.q.String()}}
+	if ex, ok := b.(Explainer); ok {
+		plan, err = ex.Explain(ctx, e.q, e.opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	plan.Backend, plan.Type, plan.Query = b.Name(), b.Type(), e.q.String()
+	for _, f := range e.filters {
+		if f.desc != "" {
+			plan.ClientSide = append(plan.ClientSide, f.desc)
+		}
+	}
+	plan.Warnings = append(plan.Warnings, e.warnings...)
+	return plan, nil
+}
@@ -3,8 +3,12 @@ package codesearch
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"iter"
 	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -12,37 +16,45 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+func init() {
+	RegisterBackend(BackendTypeGithub, NewGithub)
+}
+
 // Github implements the Backend interface
 type Github struct {
-	name              string
-	apiEndpoint       string
-	token             string
-	org               string
-	linesBefore       int
-	linesAfter        int
-	caseInsensitive   bool
-	searchInFilenames bool
+	name        string
+	apiEndpoint string
+	token       string
+	org         string
+	// symbolSearch is true if the search API supports the symbol:
+	// qualifier, see Capabilities.Symbols
+	symbolSearch bool
 }
 
-func (g *Github) New(name string, params BackendParams) (Backend, error) {
+// NewGithub creates a Github backend from its configuration parameters.
+func NewGithub(name string, params BackendParams) (Backend, error) {
 	org := params.GetString("org")
 	if org == nil {
-		return nil, fmt.Errorf("missing 'org' parameter")
+		return nil, fmt.Errorf("%w: missing 'org' parameter", ErrInvalidConfig)
 	}
 	token := params.GetString("token")
 	if token == nil {
-		return nil, fmt.Errorf("missing 'token' parameter")
+		return nil, fmt.Errorf("%w: missing 'token' parameter", ErrInvalidConfig)
 	}
 	apiEndpoint := params.GetString("api_endpoint")
 	if apiEndpoint == nil {
-		return nil, fmt.Errorf("missing 'apiEndpoint' parameter")
+		return nil, fmt.Errorf("%w: missing 'api_endpoint' parameter", ErrInvalidConfig)
 	}
-	return &Github{
+	gh := Github{
 		name:        name,
 		org:         *org,
 		token:       *token,
 		apiEndpoint: *apiEndpoint,
-	}, nil
+	}
+	if symbolSearch := params.GetBool("symbol_search"); symbolSearch != nil {
+		gh.symbolSearch = *symbolSearch
+	}
+	return &gh, nil
 }
 
 func (g *Github) Name() string {
@@ -53,180 +65,402 @@ func (g *Github) Org() string {
 	return g.org
 }
 
-func (g *Github) Type() string {
+func (g *Github) Type() BackendType {
 	return BackendTypeGithub
 }
 
-func (g *Github) SetCaseInsensitive(v bool) {
-	g.caseInsensitive = v
-}
-
-func (g *Github) SetLinesBefore(n int) {
-	g.linesBefore = n
+func (g *Github) Capabilities() Capabilities {
+	return Capabilities{
+		Regexp:          true,
+		CaseInsensitive: true,
+		Boolean:         true,
+		Symbols:         g.symbolSearch,
+		MaxContextLines: UnlimitedContextLines,
+		Qualifiers:      []string{QualifierRepo, QualifierPath, QualifierLang},
+	}
 }
 
-func (g *Github) SetLinesAfter(n int) {
-	g.linesAfter = n
+// nativeQuery translates a query to the GitHub search syntax. The directory
+// and the extension of the include glob, if any, narrow down the search, and
+// the globs are then enforced by Emulate.
+func (g *Github) nativeQuery(q *Query, pathFilter *PathFilter) string {
+	var parts []string
+	if g.org != "" {
+		parts = append(parts, "org:"+g.org)
+	}
+	for _, repo := range q.Repos {
+		if !strings.Contains(repo, "/") && g.org != "" {
+			repo = g.org + "/" + repo
+		}
+		parts = append(parts, "repo:"+repo)
+	}
+	for _, p := range q.Paths {
+		parts = append(parts, "path:"+p)
+	}
+	for _, name := range q.Langs {
+		if lang := LookupLanguage(name); lang != nil {
+			parts = append(parts, "language:"+lang.GithubName)
+		}
+	}
+	dir, ext := pathFilter.includePrefix()
+	if dir != "" {
+		parts = append(parts, "path:"+dir)
+	}
+	if ext != "" {
+		parts = append(parts, "extension:"+ext)
+	}
+	if q.Bool == nil {
+		return strings.Join(append(parts, g.nativePattern(q.Pattern, q.Kind)), " ")
+	}
+	// only flat boolean queries are passed to the backend, see
+	// Capabilities.Boolean
+	for i, sub := range q.Bool.Subs {
+		switch {
+		case sub.Op == ExprNot:
+			parts = append(parts, "NOT "+g.nativePattern(sub.Subs[0].Pattern, sub.Subs[0].Kind))
+		case q.Bool.Op == ExprOr && i > 0:
+			parts = append(parts, "OR "+g.nativePattern(sub.Pattern, sub.Kind))
+		default:
+			parts = append(parts, g.nativePattern(sub.Pattern, sub.Kind))
+		}
+	}
+	return strings.Join(parts, " ")
 }
 
-func (g *Github) SetSearchInFilenames(v bool) {
-	g.searchInFilenames = v
+// nativePattern quotes literal patterns that contain spaces or quotes.
+func (g *Github) nativePattern(pattern string, kind PatternKind) string {
+	if kind == PatternLiteral && strings.ContainsAny(pattern, " \t\"") {
+		pattern = `"` + strings.ReplaceAll(pattern, `"`, `\"`) + `"`
+	}
+	return pattern
 }
 
-func (g *Github) Search(terms string, opts ...Opt) (Results, error) {
-	searchstring := terms
-	if g.org != "" {
-		searchstring = "org:" + g.org + " " + terms
+// prepareQuery returns the search string to send to GitHub. GitHub cannot
+// search regexps, so for regexp queries it searches the literal text that the
+// matches must contain, and also returns the regexp to match on the files
+// found. For symbol searches, it searches the symbol: qualifier, and returns
+// the regexp of the names of the symbols to extract from the files found.
+func (g *Github) prepareQuery(q *Query, opts SearchOptions) (string, *regexp.Regexp, error) {
+	var re *regexp.Regexp
+	if opts.Symbol {
+		var err error
+		re, err = symbolMatcher(q, g.Capabilities(), opts)
+		if err != nil {
+			return "", nil, err
+		}
+		nq := *q
+		nq.Pattern, nq.Kind = "symbol:"+q.Pattern, PatternDefault
+		if q.Kind == PatternRegexp {
+			nq.Pattern = "symbol:/" + q.Pattern + "/"
+		}
+		q = &nq
+	} else if q.Kind == PatternRegexp {
+		var err error
+		q, re, err = literalQuery(q, g.Capabilities(), opts)
+		if err != nil {
+			return "", nil, err
+		}
 	}
-	for _, opt := range opts {
-		opt(g)
+	pathFilter, err := NewPathFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return "", nil, err
 	}
+	return g.nativeQuery(q, pathFilter), re, nil
+}
+
+// newClient returns a client for the configured API endpoint.
+func (g *Github) newClient() (*github.Client, error) {
 	u, err := url.Parse(g.apiEndpoint)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse GitHub API endpoint: %w", err)
+		return nil, fmt.Errorf("%w: failed to parse GitHub API endpoint: %w", ErrInvalidConfig, err)
 	}
 	client := github.NewClient(nil).WithAuthToken(g.token)
 	if u.Host != "api.github.com" {
 		client, err = client.WithEnterpriseURLs(g.apiEndpoint, g.apiEndpoint)
 		if err != nil {
-			return nil, fmt.Errorf("failed to configure GitHub Enterprise URLs: %w", err)
+			return nil, fmt.Errorf("%w: failed to configure GitHub Enterprise URLs: %w", ErrInvalidConfig, err)
 		}
 	}
-	ctx := context.Background()
-	sopts := github.SearchOptions{TextMatch: true}
-	var csresults []*github.CodeResult
-loop:
-	for {
-		for attempt := 0; attempt < 3; attempt++ {
-			results, response, err := client.Search.Code(ctx, searchstring, &sopts)
-			logrus.Debugf("Response: %+v", response)
-			if err != nil {
+	return client, nil
+}
+
+// Explain describes how the query is searched on GitHub. It runs the search
+// once to estimate the number of API calls.
+func (g *Github) Explain(ctx context.Context, q *Query, opts SearchOptions) (*Plan, error) {
+	searchstring, re, err := g.prepareQuery(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := g.newClient()
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{Native: []string{"code search query " + searchstring}}
+	if opts.Symbol {
+		plan.ClientSide = append(plan.ClientSide, fmt.Sprintf("fetch each file, and extract the definitions of the symbols matching %q", re))
+	} else if re != nil {
+		plan.ClientSide = append(plan.ClientSide, fmt.Sprintf("fetch each file, and match %q on its content", re))
+	} else {
+		plan.ClientSide = append(plan.ClientSide, "fetch each file, to locate the text matches and the context lines")
+	}
+	csresults, _, err := client.Search.Code(ctx, searchstring, &github.SearchOptions{ListOptions: github.ListOptions{PerPage: 1}})
+	if err != nil {
+		plan.Estimate = append(plan.Estimate, fmt.Sprintf("unknown, the first search failed: %v", githubError(err)))
+		return &plan, nil
+	}
+	// the search API returns 30 results per page, and at most 1000 results
+	files := min(csresults.GetTotal(), 1000)
+	plan.Estimate = append(plan.Estimate, fmt.Sprintf("%d files: %d search API calls (30 files per page, at most 1000 files), plus %d contents API calls", csresults.GetTotal(), (files+29)/30, files))
+	return &plan, nil
+}
+
+func (g *Github) Search(ctx context.Context, q *Query, opts SearchOptions) iter.Seq2[Result, error] {
+	return func(yield func(Result, error) bool) {
+		searchstring, re, err := g.prepareQuery(q, opts)
+		if err != nil {
+			yield(Result{}, err)
+			return
+		}
+		logrus.Debugf("GitHub query: %s", searchstring)
+		client, err := g.newClient()
+		if err != nil {
+			yield(Result{}, err)
+			return
+		}
+		sopts := github.SearchOptions{TextMatch: true}
+		for {
+			var (
+				csresults *github.CodeSearchResult
+				response  *github.Response
+			)
+			for attempt := 0; attempt < 3; attempt++ {
+				csresults, response, err = client.Search.Code(ctx, searchstring, &sopts)
+				logrus.Debugf("Response: %+v", response)
 				if rlerr, ok := err.(*github.RateLimitError); ok {
 					delay := time.Until(rlerr.Rate.Reset.Time)
 					logrus.Debugf("Hit rate limit, waiting %s before retrying", delay)
-					time.Sleep(delay)
+					if err := sleepContext(ctx, delay); err != nil {
+						yield(Result{}, fmt.Errorf("search interrupted while waiting for rate limit reset: %w", err))
+						return
+					}
 					continue
 				}
-				return nil, fmt.Errorf("search failed: %w", err)
+				break
+			}
+			if err != nil {
+				yield(Result{}, fmt.Errorf("search failed: %w", githubError(err)))
+				return
+			}
+			// fetch the file contents and emit the results one code result at
+			// a time, so that the caller does not have to wait for all the
+			// pages to be fetched
+			for _, res := range csresults.CodeResults {
+				var results Results
+				switch {
+				case opts.Symbol:
+					results, err = g.matchFile(ctx, client, res, func(content string) Results {
+						return matchSymbols(content, ExtractSymbols(*res.Path, content), re, opts)
+					})
+				case re != nil:
+					results, err = g.matchFile(ctx, client, res, func(content string) Results {
+						return matchContent(content, re, opts)
+					})
+				default:
+					results, err = g.toResult(ctx, client, res, opts)
+				}
+				if err != nil {
+					yield(Result{}, err)
+					return
+				}
+				for _, result := range results {
+					if !yield(result, nil) {
+						return
+					}
+				}
 			}
-			csresults = append(csresults, results.CodeResults...)
 			if response.NextPage == 0 {
-				break loop
+				return
 			}
 			sopts.Page = response.NextPage
 		}
 	}
-	return g.toResult(ctx, client, csresults)
-}
-
-func (g *Github) toResult(ctx context.Context, client *github.Client, csresults []*github.CodeResult) (Results, error) {
-	var results Results
-	for _, res := range csresults {
-		logrus.Debugf("Result:\n")
-		logrus.Debugf("  Name: %s:\n", *res.Name)
-		logrus.Debugf("  Path: %s:\n", *res.Path)
-		logrus.Debugf("  SHA: %s:\n", *res.SHA)
-		logrus.Debugf("  HTMLURL: %s:\n", *res.HTMLURL)
-		logrus.Debugf("  Repository: %+v:\n", res.Repository)
-		logrus.Debugf("  TextMatches:\n")
-		for idx, tm := range res.TextMatches {
-			fullPath := fmt.Sprintf("%s/%s/%s", *res.Repository.Owner.Login, *res.Repository.Name, *res.Path)
-			var (
-				rc   *github.RepositoryContent
-				resp *github.Response
-				err  error
-			)
-			for attempt := 0; attempt < 3; attempt++ {
-				logrus.Debugf("Fetching file content, owner=%q repo=%q path=%q",
-					*res.Repository.Owner.Login,
-					*res.Repository.Name,
-					*res.Path,
-				)
-				rc, _, resp, err = client.Repositories.GetContents(
-					ctx,
-					*res.Repository.Owner.Login,
-					*res.Repository.Name,
-					*res.Path,
-					&github.RepositoryContentGetOptions{},
-				)
-				logrus.Debugf("Response: %+v", resp)
-				logrus.Debugf("RepositoryContent: %+v", rc)
-				if err != nil {
-					if rlerr, ok := err.(*github.RateLimitError); ok {
-						delay := time.Until(rlerr.Rate.Reset.Time)
-						logrus.Debugf("Hit rate limit, waiting %s before retrying", delay)
-						time.Sleep(delay)
-						continue
-					}
-					return nil, fmt.Errorf("failed to get content of file %q: %w", fullPath, err)
-				}
-				break
+}
+
+// fetchContent returns the full content of the file of a code result.
+func (g *Github) fetchContent(ctx context.Context, client *github.Client, res *github.CodeResult) (string, error) {
+	fullPath := fmt.Sprintf("%s/%s/%s", *res.Repository.Owner.Login, *res.Repository.Name, *res.Path)
+	var (
+		rc   *github.RepositoryContent
+		resp *github.Response
+		err  error
+	)
+	for attempt := 0; attempt < 3; attempt++ {
+		logrus.Debugf("Fetching file content, owner=%q repo=%q path=%q",
+			*res.Repository.Owner.Login,
+			*res.Repository.Name,
+			*res.Path,
+		)
+		rc, _, resp, err = client.Repositories.GetContents(
+			ctx,
+			*res.Repository.Owner.Login,
+			*res.Repository.Name,
+			*res.Path,
+			&github.RepositoryContentGetOptions{},
+		)
+		logrus.Debugf("Response: %+v", resp)
+		logrus.Debugf("RepositoryContent: %+v", rc)
+		if rlerr, ok := err.(*github.RateLimitError); ok {
+			delay := time.Until(rlerr.Rate.Reset.Time)
+			logrus.Debugf("Hit rate limit, waiting %s before retrying", delay)
+			if err := sleepContext(ctx, delay); err != nil {
+				return "", fmt.Errorf("interrupted while waiting for rate limit reset: %w", err)
 			}
-			b64bytes, err := base64.StdEncoding.DecodeString(*rc.Content)
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get content of file %q: %w", fullPath, githubError(err))
+	}
+	b64bytes, err := base64.StdEncoding.DecodeString(*rc.Content)
+	if err != nil {
+		return "", fmt.Errorf("failed to base64-decode content of file %q: %w", fullPath, err)
+	}
+	return string(b64bytes), nil
+}
+
+// matchFile fetches the file of a code result and returns the matches that
+// match finds in its content.
+func (g *Github) matchFile(ctx context.Context, client *github.Client, res *github.CodeResult, match func(content string) Results) (Results, error) {
+	content, err := g.fetchContent(ctx, client, res)
+	if err != nil {
+		return nil, err
+	}
+	results := match(content)
+	for idx := range results {
+		fileURL, err := url.Parse(*res.HTMLURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file URL %q: %q", *res.HTMLURL, err)
+		}
+		fileURL.Fragment = fmt.Sprintf("L%d", results[idx].Start.Line)
+		results[idx].Backend = g.Name()
+		results[idx].Path = *res.Path
+		results[idx].RepoURL = *res.Repository.HTMLURL
+		results[idx].FileURL = fileURL.String()
+		results[idx].Owner = *res.Repository.Owner.Login
+		results[idx].RepoName = *res.Repository.Name
+		results[idx].Language = DetectLanguage(*res.Path, content)
+	}
+	return results, nil
+}
+
+// toResult converts a code result into one Result per matching line, with all
+// the text matches on that line as highlights.
+func (g *Github) toResult(ctx context.Context, client *github.Client, res *github.CodeResult, opts SearchOptions) (Results, error) {
+	logrus.Debugf("Result:\n")
+	logrus.Debugf("  Name: %s:\n", *res.Name)
+	logrus.Debugf("  Path: %s:\n", *res.Path)
+	logrus.Debugf("  SHA: %s:\n", *res.SHA)
+	logrus.Debugf("  HTMLURL: %s:\n", *res.HTMLURL)
+	logrus.Debugf("  Repository: %+v:\n", res.Repository)
+	logrus.Debugf("  TextMatches:\n")
+	if len(res.TextMatches) == 0 {
+		return nil, nil
+	}
+	fullText, err := g.fetchContent(ctx, client, res)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(fullText, "\n")
+	lang := DetectLanguage(*res.Path, fullText)
+	// results indexed by line number, to merge the matches on the same line
+	byLine := make(map[int]*Result)
+	for idx, tm := range res.TextMatches {
+		// find fragment in full text
+		fragmentStart := strings.Index(fullText, *tm.Fragment)
+		if fragmentStart == -1 {
+			return nil, fmt.Errorf("code fragment not found in full file content")
+		}
+		logrus.Debugf("    %d) text match:\n", idx+1)
+		logrus.Debugf("        ObjectURL: %s\n", *tm.ObjectURL)
+		logrus.Debugf("        ObjectType: %s\n", *tm.ObjectType)
+		logrus.Debugf("        Property: %s\n", *tm.Property)
+		logrus.Debugf("        Fragment: %s\n", *tm.Fragment)
+		logrus.Debugf("        Matches:\n")
+		for _, match := range tm.Matches {
+			// start of the highlight, relative to the full file content
+			start := fragmentStart + match.Indices[0]
+			length := match.Indices[1] - match.Indices[0]
+			lineno := strings.Count(fullText[:start], "\n") + 1
+			// start of the highlight, relative to the line rather than to
+			// the full text
+			startInLine := start - (strings.LastIndex(fullText[:start], "\n") + 1)
+			hl := Range{Line: 0, Start: startInLine, End: startInLine + length}
+			if result, ok := byLine[lineno]; ok {
+				result.addHighlight(hl)
+				continue
+			}
+			// try adding line number
+			fileURLwithLineno, err := url.Parse(*res.HTMLURL)
 			if err != nil {
-				return nil, fmt.Errorf("failed to base64-decode content of file %q: %w", fullPath, err)
+				return nil, fmt.Errorf("invalid file URL %q: %q", *res.HTMLURL, err)
 			}
-			fullText := string(b64bytes)
-			// find fragment in full text
-			fragmentStart := strings.Index(fullText, *tm.Fragment)
-			if fragmentStart == -1 {
-				return nil, fmt.Errorf("code fragment not found in full file content")
+			fileURLwithLineno.Fragment = fmt.Sprintf("L%d", lineno)
+			beforeIdx := lineno - 1 - opts.LinesBefore
+			if beforeIdx < 0 {
+				beforeIdx = 0
 			}
-
-			lines := strings.Split(fullText, "\n")
-			logrus.Debugf("    %d) text match:\n", idx+1)
-			logrus.Debugf("        ObjectURL: %s\n", *tm.ObjectURL)
-			logrus.Debugf("        ObjectType: %s\n", *tm.ObjectType)
-			logrus.Debugf("        Property: %s\n", *tm.Property)
-			logrus.Debugf("        Fragment: %s\n", *tm.Fragment)
-			logrus.Debugf("        Matches:\n")
-			for _, match := range tm.Matches {
-				// start of the highlight, relative to the full file content
-				start := fragmentStart + match.Indices[0]
-				length := match.Indices[1] - match.Indices[0]
-				lineno := strings.Count((fullText)[:start], "\n") + 1
-				// start of the highlight, relative to the line rather than to
-				// the full text
-				startInLine := start
-				for idx, line := range lines {
-					if idx+1 == lineno {
-						break
-					}
-					startInLine -= len(line) + 1
-				}
-				line := lines[lineno-1]
-				// try adding line number
-				fileURLwithLineno, err := url.Parse(*res.HTMLURL)
-				if err != nil {
-					return nil, fmt.Errorf("invalid file URL %q: %q", *res.HTMLURL, err)
-				}
-				fileURLwithLineno.Fragment = fmt.Sprintf("L%d", lineno+1)
-				beforeIdx := lineno - 1 - g.linesBefore
-				if beforeIdx < 0 {
-					beforeIdx = 0
-				}
-				afterIdx := lineno + g.linesAfter
-				if afterIdx > len(lines) {
-					afterIdx = len(lines)
-				}
-				result := Result{
-					Backend: g.Name(),
-					Line:    line,
-					Lineno:  lineno,
-					Context: ResultContext{
-						Before: lines[beforeIdx : lineno-1],
-						After:  lines[lineno:afterIdx],
-					},
-					Highlight: [2]int{startInLine, startInLine + length},
-					Path:      *res.Path,
-					RepoURL:   *res.Repository.HTMLURL,
-					FileURL:   fileURLwithLineno.String(),
-					Owner:     *res.Repository.Owner.Login,
-					RepoName:  *res.Repository.Name,
-				}
-				results = append(results, result)
+			afterIdx := lineno + opts.LinesAfter
+			if afterIdx > len(lines) {
+				afterIdx = len(lines)
+			}
+			byLine[lineno] = &Result{
+				Backend: g.Name(),
+				Lines:   lines[lineno-1 : lineno],
+				Start:   Position{Line: lineno, Column: hl.Start + 1},
+				End:     Position{Line: lineno, Column: hl.End + 1},
+				Context: ResultContext{
+					Before: lines[beforeIdx : lineno-1],
+					After:  lines[lineno:afterIdx],
+				},
+				Highlights: []Range{hl},
+				Path:       *res.Path,
+				RepoURL:    *res.Repository.HTMLURL,
+				FileURL:    fileURLwithLineno.String(),
+				Owner:      *res.Repository.Owner.Login,
+				RepoName:   *res.Repository.Name,
+				Language:   lang,
 			}
 		}
 	}
+	results := make(Results, 0, len(byLine))
+	for _, result := range byLine {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Lineno() < results[j].Lineno() })
 	return results, nil
 }
+
+// githubError converts the errors returned by the GitHub client to the errors
+// defined in this package.
+func githubError(err error) error {
+	var (
+		rlerr    *github.RateLimitError
+		abuseErr *github.AbuseRateLimitError
+		respErr  *github.ErrorResponse
+	)
+	switch {
+	case errors.As(err, &rlerr):
+		return &RateLimitError{Reset: rlerr.Rate.Reset.Time, Err: err}
+	case errors.As(err, &abuseErr):
+		rerr := &RateLimitError{Err: err}
+		if abuseErr.RetryAfter != nil {
+			rerr.Reset = time.Now().Add(*abuseErr.RetryAfter)
+		}
+		return rerr
+	case errors.As(err, &respErr) && respErr.Response != nil:
+		return httpStatusError(respErr.Response.StatusCode, err)
+	default:
+		return err
+	}
+}
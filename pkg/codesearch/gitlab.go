@@ -1,40 +1,47 @@
 package codesearch
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"iter"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	gitlab "github.com/xanzy/go-gitlab"
 )
 
+func init() {
+	RegisterBackend(BackendTypeGitlab, NewGitlab)
+}
+
 // Gitlab implements the Backend interface
 type Gitlab struct {
-	name              string
-	apiEndpoint       string
-	token             string
-	group             string
-	project           string
-	linesBefore       int
-	linesAfter        int
-	caseInsensitive   bool
-	searchInFilenames bool
+	name        string
+	apiEndpoint string
+	token       string
+	group       string
+	project     string
 }
 
-func (g *Gitlab) New(name string, params BackendParams) (Backend, error) {
+// NewGitlab creates a Gitlab backend from its configuration parameters.
+func NewGitlab(name string, params BackendParams) (Backend, error) {
 	group := params.GetString("group")
 	project := params.GetString("project")
 	if group != nil && project != nil {
-		return nil, fmt.Errorf("cannot specify both 'project' and 'group'")
+		return nil, fmt.Errorf("%w: cannot specify both 'project' and 'group'", ErrInvalidConfig)
 	}
 	token := params.GetString("token")
 	if token == nil {
-		return nil, fmt.Errorf("missing 'token' parameter")
+		return nil, fmt.Errorf("%w: missing 'token' parameter", ErrInvalidConfig)
 	}
 	apiEndpoint := params.GetString("api_endpoint")
 	if apiEndpoint == nil {
-		return nil, fmt.Errorf("missing 'apiEndpoint' parameter")
+		return nil, fmt.Errorf("%w: missing 'api_endpoint' parameter", ErrInvalidConfig)
 	}
 	gl := Gitlab{
 		name:        name,
@@ -62,33 +69,153 @@ func (g *Gitlab) Projet() string {
 	return g.project
 }
 
-func (g *Gitlab) Type() string {
+func (g *Gitlab) Type() BackendType {
 	return BackendTypeGitlab
 }
 
-func (g *Gitlab) SetCaseInsensitive(v bool) {
-	g.caseInsensitive = v
+func (g *Gitlab) Capabilities() Capabilities {
+	// the blobs returned by the search API only contain a few lines around
+	// the match. The search API also matches the file names, and those
+	// blobs are returned as file name results
+	return Capabilities{
+		Regexp:            true,
+		CaseInsensitive:   true,
+		SearchInFilenames: true,
+		MaxContextLines:   3,
+		Qualifiers:        []string{QualifierPath},
+	}
 }
 
-func (g *Gitlab) SetLinesBefore(n int) {
-	g.linesBefore = n
+// nativeQuery translates a query to the GitLab search syntax. GitLab's path
+// filter can only be used once, so multiple path qualifiers are applied
+// client-side. The directory and the extension of the include glob, if any,
+// narrow down the search, and the globs are then enforced by Emulate.
+func (g *Gitlab) nativeQuery(q *Query, pathFilter *PathFilter) string {
+	searchString := q.Pattern
+	dir, ext := pathFilter.includePrefix()
+	if len(q.Paths) == 1 {
+		searchString += " path:" + q.Paths[0]
+	} else if len(q.Paths) == 0 && dir != "" {
+		searchString += " path:" + dir
+	}
+	// the languages are enforced by Emulate, but a single extension can
+	// be pushed down
+	if ext == "" && len(q.Langs) == 1 {
+		if lang := LookupLanguage(q.Langs[0]); lang != nil && len(lang.Extensions) == 1 && len(lang.Filenames) == 0 && len(lang.Interpreters) == 0 {
+			ext = strings.TrimPrefix(lang.Extensions[0], ".")
+		}
+	}
+	if ext != "" {
+		searchString += " extension:" + ext
+	}
+	return searchString
 }
 
-func (g *Gitlab) SetLinesAfter(n int) {
-	g.linesAfter = n
+func (g *Gitlab) Search(ctx context.Context, q *Query, opts SearchOptions) iter.Seq2[Result, error] {
+	return func(yield func(Result, error) bool) {
+		searchString, q, re, err := g.prepareQuery(q, opts)
+		if err != nil {
+			yield(Result{}, err)
+			return
+		}
+		logrus.Debugf("GitLab query: %s", searchString)
+		client, err := g.newClient()
+		if err != nil {
+			yield(Result{}, err)
+			return
+		}
+		searchPage, _, err := g.blobSearcher(ctx, client, searchString)
+		if err != nil {
+			yield(Result{}, err)
+			return
+		}
+		projects := make(map[int]*gitlab.Project)
+		// files already matched with the regexp, since GitLab returns one
+		// blob per matching chunk of a file
+		matched := make(map[string]struct{})
+		sopts := gitlab.SearchOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+		for {
+			blobs, response, err := searchPage(&sopts)
+			if err != nil {
+				yield(Result{}, err)
+				return
+			}
+			for _, blob := range blobs {
+				// apply the qualifiers before fetching anything. Like on
+				// csearch, the language of files without a known name or
+				// extension is detected from their content, if the blob
+				// starts at the beginning of the file. Otherwise, it is
+				// checked on the results
+				if !q.matchPaths(blob.Path) {
+					continue
+				}
+				lang := DetectLanguage(blob.Path, "")
+				if lang == "" && blob.Startline == 1 {
+					lang = DetectLanguage(blob.Path, blob.Data)
+				}
+				if (lang != "" || blob.Startline == 1) && !q.MatchLang(lang) {
+					continue
+				}
+				if re != nil {
+					key := fmt.Sprintf("%d/%s", blob.ProjectID, blob.Path)
+					if _, ok := matched[key]; ok {
+						continue
+					}
+					matched[key] = struct{}{}
+					results, err := g.matchRegexp(ctx, client, blob, projects, re, opts)
+					if err != nil {
+						yield(Result{}, err)
+						return
+					}
+					for _, result := range results {
+						if !yield(result, nil) {
+							return
+						}
+					}
+					continue
+				}
+				result, err := g.toResult(ctx, client, q.Pattern, blob, projects, opts)
+				if err != nil {
+					yield(Result{}, err)
+					return
+				}
+				if !yield(*result, nil) {
+					return
+				}
+			}
+			if response.NextPage == 0 {
+				return
+			}
+			sopts.Page = response.NextPage
+		}
+	}
 }
 
-func (g *Gitlab) SetSearchInFilenames(v bool) {
-	g.searchInFilenames = v
+// prepareQuery returns the search string to send to GitLab. GitLab cannot
+// search regexps, so for regexp queries it searches the literal text that the
+// matches must contain, and also returns the literal query and the regexp to
+// match on the files found.
+func (g *Gitlab) prepareQuery(q *Query, opts SearchOptions) (string, *Query, *regexp.Regexp, error) {
+	var re *regexp.Regexp
+	if q.Kind == PatternRegexp {
+		var err error
+		q, re, err = literalQuery(q, g.Capabilities(), opts)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+	pathFilter, err := NewPathFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return g.nativeQuery(q, pathFilter), q, re, nil
 }
 
-func (g *Gitlab) Search(searchString string, opts ...Opt) (Results, error) {
-	for _, opt := range opts {
-		opt(g)
-	}
+// newClient returns a client for the configured API endpoint.
+func (g *Gitlab) newClient() (*gitlab.Client, error) {
 	u, err := url.Parse(g.apiEndpoint)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse Gitlab API endpoint: %w", err)
+		return nil, fmt.Errorf("%w: failed to parse Gitlab API endpoint: %w", ErrInvalidConfig, err)
 	}
 	if u.Scheme == "" {
 		u.Scheme = "https"
@@ -101,18 +228,22 @@ func (g *Gitlab) Search(searchString string, opts ...Opt) (Results, error) {
 	}
 	client, err := gitlab.NewClient(g.token, gitlab.WithBaseURL(u.String()))
 	if err != nil {
-		return nil, fmt.Errorf("failed to set up Gitlab client: %w", err)
+		return nil, fmt.Errorf("%w: failed to set up Gitlab client: %w", ErrInvalidConfig, err)
 	}
-	var (
-		blobs []*gitlab.Blob
-	)
+	return client, nil
+}
+
+// blobSearcher returns a function that fetches one page of blobs, searching
+// either in the configured group, in the configured project, or globally. It
+// also returns a description of where the search happens.
+func (g *Gitlab) blobSearcher(ctx context.Context, client *gitlab.Client, searchString string) (func(sopts *gitlab.SearchOptions) ([]*gitlab.Blob, *gitlab.Response, error), string, error) {
 	if g.group != "" {
 		// get group ID
 		// XXX Should this request be paginated as well?
-		groups, response, err := client.Groups.ListGroups(&gitlab.ListGroupsOptions{})
+		groups, response, err := client.Groups.ListGroups(&gitlab.ListGroupsOptions{}, gitlab.WithContext(ctx))
 		logrus.Debugf("Search.ListGroups response: %+v", response)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get group list: %w", err)
+			return nil, "", fmt.Errorf("failed to get group list: %w", gitlabError(err))
 		}
 		groupID := -1
 		for _, group := range groups {
@@ -122,142 +253,254 @@ func (g *Gitlab) Search(searchString string, opts ...Opt) (Results, error) {
 			}
 		}
 		if groupID == -1 {
-			return nil, fmt.Errorf("group %q not found", g.group)
+			return nil, "", fmt.Errorf("%w: group %q", ErrNotFound, g.group)
 		}
-		sopts := gitlab.SearchOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
-		for {
-			someBlobs, response, err := client.Search.BlobsByGroup(groupID, searchString, &sopts)
+		return func(sopts *gitlab.SearchOptions) ([]*gitlab.Blob, *gitlab.Response, error) {
+			blobs, response, err := client.Search.BlobsByGroup(groupID, searchString, sopts, gitlab.WithContext(ctx))
 			logrus.Debugf("Search.BlobsByGroup response: %+v", response)
 			if err != nil {
-				return nil, fmt.Errorf("failed to search blobs by project: %w", err)
+				return nil, nil, fmt.Errorf("failed to search blobs by group: %w", gitlabError(err))
 			}
-			sopts.Page = response.NextPage
-			blobs = append(blobs, someBlobs...)
-			if response.NextPage == 0 {
-				break
-			}
-		}
-	} else if g.project != "" {
+			return blobs, response, nil
+		}, fmt.Sprintf("group %q (ID %d)", g.group, groupID), nil
+	}
+	if g.project != "" {
 		// get project ID
 		// XXX Should this request be paginated as well?
-		projects, response, err := client.Projects.ListProjects(&gitlab.ListProjectsOptions{})
+		projects, response, err := client.Projects.ListProjects(&gitlab.ListProjectsOptions{}, gitlab.WithContext(ctx))
 		logrus.Debugf("Search.ListProjects response: %+v", response)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get project list: %w", err)
+			return nil, "", fmt.Errorf("failed to get project list: %w", gitlabError(err))
 		}
-		projectID := 0
+		projectID := -1
 		for _, proj := range projects {
 			if proj.Name == g.project {
 				projectID = proj.ID
 				break
 			}
 		}
-		sopts := gitlab.SearchOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
-		for {
-			someBlobs, response, err := client.Search.BlobsByProject(projectID, searchString, &sopts)
+		if projectID == -1 {
+			return nil, "", fmt.Errorf("%w: project %q", ErrNotFound, g.project)
+		}
+		return func(sopts *gitlab.SearchOptions) ([]*gitlab.Blob, *gitlab.Response, error) {
+			blobs, response, err := client.Search.BlobsByProject(projectID, searchString, sopts, gitlab.WithContext(ctx))
 			logrus.Debugf("Search.BlobsByProject response: %+v", response)
 			if err != nil {
-				return nil, fmt.Errorf("failed to search blobs by group: %w", err)
-			}
-			sopts.Page = response.NextPage
-			blobs = append(blobs, someBlobs...)
-			if response.NextPage == 0 {
-				break
+				return nil, nil, fmt.Errorf("failed to search blobs by project: %w", gitlabError(err))
 			}
+			return blobs, response, nil
+		}, fmt.Sprintf("project %q (ID %d)", g.project, projectID), nil
+	}
+	return func(sopts *gitlab.SearchOptions) ([]*gitlab.Blob, *gitlab.Response, error) {
+		blobs, response, err := client.Search.Blobs(searchString, sopts, gitlab.WithContext(ctx))
+		logrus.Debugf("Search.Blobs response: %+v", response)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to search blobs: %w", gitlabError(err))
 		}
+		return blobs, response, nil
+	}, "all the projects", nil
+}
+
+// Explain describes how the query is searched on GitLab. It resolves the
+// group or project, and fetches the first page of results to estimate the
+// number of API calls.
+func (g *Gitlab) Explain(ctx context.Context, q *Query, opts SearchOptions) (*Plan, error) {
+	searchString, _, re, err := g.prepareQuery(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := g.newClient()
+	if err != nil {
+		return nil, err
+	}
+	searchPage, where, err := g.blobSearcher(ctx, client, searchString)
+	if err != nil {
+		return nil, err
+	}
+	plan := Plan{
+		Native: []string{
+			fmt.Sprintf("search blobs in %s", where),
+			fmt.Sprintf("query %s", searchString),
+		},
+	}
+	if re != nil {
+		plan.ClientSide = append(plan.ClientSide, fmt.Sprintf("fetch each file, and match %q on its content", re))
 	} else {
-		sopts := gitlab.SearchOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
-		for {
-			someBlobs, response, err := client.Search.Blobs(searchString, &sopts)
-			logrus.Debugf("Search.Blobs response: %+v", response)
-			if err != nil {
-				return nil, fmt.Errorf("failed to search blobs: %w", err)
-			}
-			sopts.Page = response.NextPage
-			blobs = append(blobs, someBlobs...)
-			if response.NextPage == 0 {
-				break
-			}
+		plan.ClientSide = append(plan.ClientSide, "locate the first match in each returned blob")
+	}
+	if len(q.Paths) > 1 {
+		plan.ClientSide = append(plan.ClientSide, fmt.Sprintf("path qualifiers %q", q.Paths))
+	}
+	blobs, response, err := searchPage(&gitlab.SearchOptions{ListOptions: gitlab.ListOptions{PerPage: 100}})
+	switch {
+	case err != nil:
+		plan.Estimate = append(plan.Estimate, fmt.Sprintf("unknown, the first search failed: %v", err))
+	case response.TotalItems > 0:
+		estimate := fmt.Sprintf("%d blobs: %d search API calls (100 blobs per page), plus 1 API call per project", response.TotalItems, response.TotalPages)
+		if re != nil {
+			estimate += ", plus 1 API call per file"
+		}
+		plan.Estimate = append(plan.Estimate, estimate)
+	default:
+		estimate := fmt.Sprintf("GitLab did not report the number of blobs, the first page has %d", len(blobs))
+		if response.NextPage != 0 {
+			estimate += ", and there are more"
 		}
+		plan.Estimate = append(plan.Estimate, estimate)
 	}
-	return g.toResult(client, searchString, blobs)
+	return &plan, nil
 }
 
-func (g *Gitlab) toResult(client *gitlab.Client, searchString string, blobs []*gitlab.Blob) (Results, error) {
-	var (
-		results  Results
-		projects = make(map[int]*gitlab.Project, 0)
-	)
-	for _, blob := range blobs {
-		logrus.Debugf("Result:")
-		logrus.Debugf("  Basename: %s:", blob.Basename)
-		logrus.Debugf("  Data: %s:", blob.Data)
-		logrus.Debugf("  Path: %s:", blob.Path)
-		logrus.Debugf("  Filename: %s:", blob.Filename)
-		logrus.Debugf("  ID: %s", blob.ID)
-		logrus.Debugf("  Ref: %s", blob.Ref)
-		logrus.Debugf("  Startline: %d", blob.Startline)
-		logrus.Debugf("  ProjectID: %d", blob.ProjectID)
+// toResult converts a blob into a Result. The projects map is used to cache
+// the projects that have already been fetched.
+func (g *Gitlab) toResult(ctx context.Context, client *gitlab.Client, searchString string, blob *gitlab.Blob, projects map[int]*gitlab.Project, opts SearchOptions) (*Result, error) {
+	logrus.Debugf("Result:")
+	logrus.Debugf("  Basename: %s:", blob.Basename)
+	logrus.Debugf("  Data: %s:", blob.Data)
+	logrus.Debugf("  Path: %s:", blob.Path)
+	logrus.Debugf("  Filename: %s:", blob.Filename)
+	logrus.Debugf("  ID: %s", blob.ID)
+	logrus.Debugf("  Ref: %s", blob.Ref)
+	logrus.Debugf("  Startline: %d", blob.Startline)
+	logrus.Debugf("  ProjectID: %d", blob.ProjectID)
 
-		if _, ok := projects[blob.ProjectID]; !ok {
-			project, response, err := client.Projects.GetProject(blob.ProjectID, &gitlab.GetProjectOptions{})
-			logrus.Debugf("Projects.GetProject response: %+v", response)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get project with ID %q: %w", blob.ProjectID, err)
-			}
-			projects[blob.ProjectID] = project
-		}
-		logrus.Debugf("  Project Name: %s", projects[blob.ProjectID].Name)
+	project, err := g.getProject(ctx, client, blob.ProjectID, projects)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("  Project Name: %s", project.Name)
 
-		project := projects[blob.ProjectID]
-		startOffset := strings.Index(strings.ToLower(blob.Data), strings.ToLower(searchString))
-		var (
-			start, end int
-			line       string
-		)
-		result := Result{
-			Backend:    g.Name(),
-			IsFilename: false,
-			Path:       blob.Path,
-			RepoURL:    project.WebURL,
-			FileURL:    fmt.Sprintf("%s/-/blob/%s/%s", project.WebURL, project.DefaultBranch, blob.Path),
-			Owner:      project.Namespace.Path,
-			RepoName:   project.Path,
-			Branch:     project.DefaultBranch,
+	// GitLab matches case-insensitively, so prefer the first occurrence with
+	// the same case for case-sensitive searches. Emulate drops the results
+	// that don't have any
+	startOffset := -1
+	if !opts.CaseInsensitive {
+		startOffset = strings.Index(blob.Data, searchString)
+	}
+	if startOffset == -1 {
+		if ranges := findAllFold(blob.Data, searchString); len(ranges) > 0 {
+			startOffset = ranges[0].Start
 		}
-		if startOffset == -1 {
-			// The search pattern was found in the file name, not in the file
-			// content, so it's marked as such. Line, StartLine, Lineno, Context
-			// and Highlight are not set
-			result.IsFilename = true
-		} else {
-			lines := strings.Split(blob.Data, "\n")
-			linenoInBlob := strings.Count(blob.Data[:startOffset], "\n")
-			line = lines[linenoInBlob]
-			start = strings.Index(strings.ToLower(line), strings.ToLower(searchString))
-			end = start + len(searchString)
-			// TODO fetch entire file content if the requested context is longer
-			// than the available one
-			beforeIdx := linenoInBlob - g.linesBefore
-			if beforeIdx < 0 {
-				beforeIdx = 0
-			}
-			afterIdx := linenoInBlob + g.linesAfter + 1
-			if afterIdx > len(lines) {
-				afterIdx = len(lines)
-			}
-			result.Lineno = blob.Startline
-			result.Context = ResultContext{
-				Before: lines[beforeIdx:linenoInBlob],
-				After:  lines[linenoInBlob+1 : afterIdx],
-			}
-			result.Highlight = [2]int{start, end}
-			result.Line = line
-			result.Lineno = blob.Startline + linenoInBlob
-			// add line fragment to URL
-			result.FileURL = fmt.Sprintf("%s/-/blob/%s/%s#L%d", project.WebURL, project.DefaultBranch, blob.Path, blob.Startline+linenoInBlob)
+	}
+	result := Result{
+		Backend:    g.Name(),
+		IsFilename: false,
+		Path:       blob.Path,
+		RepoURL:    project.WebURL,
+		FileURL:    fmt.Sprintf("%s/-/blob/%s/%s", project.WebURL, project.DefaultBranch, blob.Path),
+		Owner:      project.Namespace.Path,
+		RepoName:   project.Path,
+		Branch:     project.DefaultBranch,
+	}
+	// the shebang line is only available if the blob starts at the
+	// beginning of the file
+	if blob.Startline == 1 {
+		result.Language = DetectLanguage(blob.Path, blob.Data)
+	} else {
+		result.Language = DetectLanguage(blob.Path, "")
+	}
+	if startOffset == -1 {
+		// The search pattern was found in the file name, not in the file
+		// content, so it's marked as such. Lines, Start, End, Context and
+		// Highlights are not set
+		result.IsFilename = true
+	} else {
+		lines := strings.Split(blob.Data, "\n")
+		linenoInBlob := strings.Count(blob.Data[:startOffset], "\n")
+		line := lines[linenoInBlob]
+		// TODO fetch entire file content if the requested context is longer
+		// than the available one
+		beforeIdx := linenoInBlob - opts.LinesBefore
+		if beforeIdx < 0 {
+			beforeIdx = 0
+		}
+		afterIdx := linenoInBlob + opts.LinesAfter + 1
+		if afterIdx > len(lines) {
+			afterIdx = len(lines)
 		}
-		results = append(results, result)
+		result.Context = ResultContext{
+			Before: lines[beforeIdx:linenoInBlob],
+			After:  lines[linenoInBlob+1 : afterIdx],
+		}
+		result.Lines = []string{line}
+		result.Start = Position{Line: blob.Startline + linenoInBlob}
+		result.End = Position{Line: blob.Startline + linenoInBlob}
+		result.Highlights = findAllFold(line, searchString)
+		result.updateColumns()
+		// add line fragment to URL
+		result.FileURL = fmt.Sprintf("%s/-/blob/%s/%s#L%d", project.WebURL, project.DefaultBranch, blob.Path, blob.Startline+linenoInBlob)
+	}
+	return &result, nil
+}
+
+// getProject returns the project with the given ID. The projects map is used
+// to cache the projects that have already been fetched.
+func (g *Gitlab) getProject(ctx context.Context, client *gitlab.Client, id int, projects map[int]*gitlab.Project) (*gitlab.Project, error) {
+	if project, ok := projects[id]; ok {
+		return project, nil
+	}
+	project, response, err := client.Projects.GetProject(id, &gitlab.GetProjectOptions{}, gitlab.WithContext(ctx))
+	logrus.Debugf("Projects.GetProject response: %+v", response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get project with ID %d: %w", id, gitlabError(err))
+	}
+	projects[id] = project
+	return project, nil
+}
+
+// matchRegexp fetches the file of a blob and returns the matches of the
+// regexp in its content.
+func (g *Gitlab) matchRegexp(ctx context.Context, client *gitlab.Client, blob *gitlab.Blob, projects map[int]*gitlab.Project, re *regexp.Regexp, opts SearchOptions) (Results, error) {
+	project, err := g.getProject(ctx, client, blob.ProjectID, projects)
+	if err != nil {
+		return nil, err
+	}
+	content, response, err := client.RepositoryFiles.GetRawFile(blob.ProjectID, blob.Path, &gitlab.GetRawFileOptions{Ref: gitlab.Ptr(blob.Ref)}, gitlab.WithContext(ctx))
+	logrus.Debugf("RepositoryFiles.GetRawFile response: %+v", response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content of file %q: %w", blob.Path, gitlabError(err))
+	}
+	results := matchContent(string(content), re, opts)
+	for idx := range results {
+		results[idx].Backend = g.Name()
+		results[idx].Path = blob.Path
+		results[idx].RepoURL = project.WebURL
+		results[idx].FileURL = fmt.Sprintf("%s/-/blob/%s/%s#L%d", project.WebURL, blob.Ref, blob.Path, results[idx].Start.Line)
+		results[idx].Owner = project.Namespace.Path
+		results[idx].RepoName = project.Path
+		results[idx].Branch = blob.Ref
+		results[idx].Language = DetectLanguage(blob.Path, string(content))
 	}
 	return results, nil
 }
+
+// findAllFold returns the ranges of all the non-overlapping, case-insensitive
+// occurrences of substr in s. The ranges are byte offsets in s, even where
+// lowercasing would change the length of the text.
+func findAllFold(s, substr string) []Range {
+	if substr == "" {
+		return nil
+	}
+	var ranges []Range
+	for _, loc := range regexp.MustCompile("(?i)"+regexp.QuoteMeta(substr)).FindAllStringIndex(s, -1) {
+		ranges = append(ranges, Range{Start: loc[0], End: loc[1]})
+	}
+	return ranges
+}
+
+// gitlabError converts the errors returned by the GitLab client to the errors
+// defined in this package.
+func gitlabError(err error) error {
+	var respErr *gitlab.ErrorResponse
+	if errors.As(err, &respErr) && respErr.Response != nil {
+		if respErr.Response.StatusCode == 429 {
+			rerr := &RateLimitError{Err: err}
+			if reset, err := strconv.ParseInt(respErr.Response.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+				rerr.Reset = time.Unix(reset, 0)
+			}
+			return rerr
+		}
+		return httpStatusError(respErr.Response.StatusCode, err)
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+package codesearch
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFindAllFold(t *testing.T) {
+	for _, tt := range []struct {
+		s, substr string
+		want      []Range
+	}{
+		{s: "foo bar foo", substr: "foo", want: []Range{{Start: 0, End: 3}, {Start: 8, End: 11}}},
+		{s: "Foo FOO fOo", substr: "foo", want: []Range{{Start: 0, End: 3}, {Start: 4, End: 7}, {Start: 8, End: 11}}},
+		{s: "aaaa", substr: "aa", want: []Range{{Start: 0, End: 2}, {Start: 2, End: 4}}},
+		{s: "a.b axb", substr: "a.b", want: []Range{{Start: 0, End: 3}}},
+		{s: "foo", substr: "bar", want: nil},
+		{s: "foo", substr: "", want: nil},
+		// "İ" is 2 bytes, but 3 bytes once lowercased
+		{s: "İstanbul foo", substr: "foo", want: []Range{{Start: 10, End: 13}}},
+		{s: "İstanbul FOO", substr: "foo", want: []Range{{Start: 10, End: 13}}},
+		{s: "café CAFÉ", substr: "café", want: []Range{{Start: 0, End: 5}, {Start: 6, End: 11}}},
+	} {
+		if got := findAllFold(tt.s, tt.substr); !slices.Equal(got, tt.want) {
+			t.Errorf("findAllFold(%q, %q) = %v, want %v", tt.s, tt.substr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package codesearch
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathFilter selects files by path with include and exclude globs.
+//
+// Globs follow the gitignore conventions: a glob without a slash matches the
+// file or directory name at any depth, e.g. "*.pb.go" or "vendor", while a
+// glob with a slash is anchored at the root of the repository, e.g.
+// "cmd/*/main.go" or "/vendor". "**" matches any number of directories, and a
+// glob that matches a directory matches all the files below it. A glob with a
+// trailing slash, e.g. "build/", only matches directories.
+//
+// A glob starting with "!" is negated. The globs of each list are evaluated in
+// order, and the last one that matches a path decides. If the include list
+// only has negated globs, all the other paths are included.
+type PathFilter struct {
+	include []glob
+	exclude []glob
+}
+
+type glob struct {
+	pattern string
+	negated bool
+	re      *regexp.Regexp
+}
+
+// NewPathFilter compiles the include and exclude globs.
+func NewPathFilter(include, exclude []string) (*PathFilter, error) {
+	var f PathFilter
+	for _, list := range []struct {
+		patterns []string
+		globs    *[]glob
+	}{{include, &f.include}, {exclude, &f.exclude}} {
+		for _, pattern := range list.patterns {
+			g, err := compileGlob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			*list.globs = append(*list.globs, *g)
+		}
+	}
+	return &f, nil
+}
+
+// compileGlob translates a glob to a regular expression.
+func compileGlob(pattern string) (*glob, error) {
+	g := glob{pattern: pattern}
+	p := pattern
+	if strings.HasPrefix(p, "!") {
+		g.negated = true
+		p = p[1:]
+	}
+	dir := strings.HasSuffix(p, "/")
+	anchored := strings.Contains(strings.TrimSuffix(p, "/"), "/")
+	p = strings.TrimPrefix(strings.TrimSuffix(p, "/"), "/")
+	if p == "" {
+		return nil, fmt.Errorf("%w: empty glob %q", ErrInvalidQuery, pattern)
+	}
+	var expr strings.Builder
+	if anchored {
+		expr.WriteString("^")
+	} else {
+		expr.WriteString("(?:^|/)")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("%w: unterminated character class in glob %q", ErrInvalidQuery, pattern)
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(p):
+			i++
+			expr.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	// a directory matches all the files below it, and a glob with a trailing
+	// slash only matches directories
+	if dir {
+		expr.WriteString("/.*$")
+	} else {
+		expr.WriteString("(?:/.*)?$")
+	}
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid glob %q: %w", ErrInvalidQuery, pattern, err)
+	}
+	g.re = re
+	return &g, nil
+}
+
+// IsEmpty returns true if the filter selects all the paths.
+func (f *PathFilter) IsEmpty() bool {
+	return f == nil || len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// Match returns true if the path is included and not excluded. The path is
+// relative to the root of its repository.
+func (f *PathFilter) Match(p string) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	p = strings.TrimPrefix(p, "/")
+	included := true
+	for _, g := range f.include {
+		if !g.negated {
+			included = false
+			break
+		}
+	}
+	for _, g := range f.include {
+		if g.re.MatchString(p) {
+			included = !g.negated
+		}
+	}
+	if !included {
+		return false
+	}
+	excluded := false
+	for _, g := range f.exclude {
+		if g.re.MatchString(p) {
+			excluded = !g.negated
+		}
+	}
+	return !excluded
+}
+
+// includePrefix returns the directory and the file extension that all the
+// included paths have, if the filter has a single include glob. Backends can
+// use them to narrow down their native query, e.g. "src/**/*.go" returns
+// "src" and "go".
+func (f *PathFilter) includePrefix() (dir, ext string) {
+	if f.IsEmpty() || len(f.include) != 1 || f.include[0].negated {
+		return "", ""
+	}
+	p := strings.TrimPrefix(f.include[0].pattern, "/")
+	trimmed := strings.TrimSuffix(p, "/")
+	if strings.Contains(trimmed, "/") {
+		segments := strings.Split(trimmed, "/")
+		var parts []string
+		for _, part := range segments {
+			if strings.ContainsAny(part, `*?[\`) {
+				break
+			}
+			parts = append(parts, part)
+		}
+		// the last segment is the file name, unless the glob ends with a
+		// slash
+		if len(parts) == len(segments) && trimmed == p {
+			parts = parts[:len(parts)-1]
+		}
+		dir = strings.Join(parts, "/")
+	}
+	base := path.Base(p)
+	if strings.HasPrefix(base, "*.") && !strings.ContainsAny(base[2:], `*?[\.`) {
+		ext = base[2:]
+	}
+	return dir, ext
+}
@@ -0,0 +1,170 @@
+package codesearch
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPathFilterMatch(t *testing.T) {
+	for _, tt := range []struct {
+		include, exclude []string
+		matches          []string
+		rejects          []string
+	}{
+		{
+			// no globs
+			matches: []string{"main.go", "a/b/c.txt"},
+		},
+		{
+			// unanchored globs match the name at any depth
+			include: []string{"*.go"},
+			matches: []string{"main.go", "cmd/cs/main.go", "/main.go"},
+			rejects: []string{"main.go.orig", "README.md", "go/README.md"},
+		},
+		{
+			exclude: []string{"vendor"},
+			matches: []string{"main.go", "vendors/x.go", "src/myvendor/x.go"},
+			rejects: []string{"vendor", "vendor/x.go", "src/vendor/x.go", "a/vendor/b/c.go"},
+		},
+		{
+			// a glob with a slash is anchored at the root
+			exclude: []string{"vendor/**"},
+			matches: []string{"src/vendor/x.go", "vendor", "main.go"},
+			rejects: []string{"vendor/x.go", "vendor/a/b/c.go"},
+		},
+		{
+			exclude: []string{"/vendor"},
+			matches: []string{"src/vendor/x.go"},
+			rejects: []string{"vendor", "vendor/x.go"},
+		},
+		{
+			include: []string{"cmd/*/main.go"},
+			matches: []string{"cmd/cs/main.go", "/cmd/cs/main.go"},
+			rejects: []string{"cmd/main.go", "cmd/a/b/main.go", "x/cmd/cs/main.go"},
+		},
+		{
+			// a trailing slash only matches directories
+			exclude: []string{"build/"},
+			matches: []string{"build", "builder/x", "src/build.go"},
+			rejects: []string{"build/x", "src/build/x/y"},
+		},
+		{
+			exclude: []string{"docs/api/"},
+			matches: []string{"docs/api", "src/docs/api/x.md"},
+			rejects: []string{"docs/api/x.md"},
+		},
+		{
+			// ** at the start, in the middle and at the end
+			include: []string{"**/testdata/*.json"},
+			matches: []string{"testdata/a.json", "a/b/testdata/c.json"},
+			rejects: []string{"testdata/a/b.json", "testdata.json"},
+		},
+		{
+			include: []string{"src/**/*.go"},
+			matches: []string{"src/main.go", "src/a/main.go", "src/a/b/c/main.go"},
+			rejects: []string{"main.go", "lib/src/main.go", "src/main.c"},
+		},
+		{
+			include: []string{"src/**"},
+			matches: []string{"src/a", "src/a/b/c"},
+			rejects: []string{"src", "lib/src/a"},
+		},
+		{
+			include: []string{"**"},
+			matches: []string{"a", "a/b/c"},
+		},
+		{
+			// character classes and single characters
+			include: []string{"file?.[ch]", "[!x]y.txt"},
+			matches: []string{"file1.c", "a/fileA.h", "ay.txt"},
+			rejects: []string{"file12.c", "file1.go", "xy.txt", "file/.c"},
+		},
+		{
+			// escapes
+			include: []string{`\*.go`},
+			matches: []string{"*.go"},
+			rejects: []string{"main.go"},
+		},
+		{
+			// negated globs, the last matching glob decides
+			exclude: []string{"*_test.go", "!important_test.go"},
+			matches: []string{"main.go", "important_test.go", "a/important_test.go"},
+			rejects: []string{"main_test.go", "a/b_test.go"},
+		},
+		{
+			exclude: []string{"!keep.go", "*.go"},
+			rejects: []string{"keep.go", "main.go"},
+		},
+		{
+			// only negated includes include everything else
+			include: []string{"!*.md"},
+			matches: []string{"main.go", "docs/x.txt"},
+			rejects: []string{"README.md", "docs/x.md"},
+		},
+		{
+			// include and exclude together: excludes apply to the included
+			// paths
+			include: []string{"src/**/*.go"},
+			exclude: []string{"*_test.go", "src/gen/"},
+			matches: []string{"src/main.go", "src/a/b.go"},
+			rejects: []string{"src/main_test.go", "src/gen/x.go", "src/README.md", "main.go"},
+		},
+		{
+			include: []string{"*.go", "*.proto"},
+			exclude: []string{"vendor", "!vendor/keep/**"},
+			matches: []string{"main.go", "api.proto", "vendor/keep/x.go"},
+			rejects: []string{"vendor/x.go", "src/vendor/x.proto", "vendor/keep/x.txt"},
+		},
+	} {
+		name := "include=" + strings.Join(tt.include, ",") + " exclude=" + strings.Join(tt.exclude, ",")
+		t.Run(name, func(t *testing.T) {
+			f, err := NewPathFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatalf("NewPathFilter failed: %v", err)
+			}
+			for _, p := range tt.matches {
+				if !f.Match(p) {
+					t.Errorf("Match(%q) = false, want true", p)
+				}
+			}
+			for _, p := range tt.rejects {
+				if f.Match(p) {
+					t.Errorf("Match(%q) = true, want false", p)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPathFilterErrors(t *testing.T) {
+	for _, pattern := range []string{"", "!", "/", "file[ab", "!/"} {
+		if _, err := NewPathFilter([]string{pattern}, nil); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("NewPathFilter(%q) error = %v, want %v", pattern, err, ErrInvalidQuery)
+		}
+	}
+}
+
+func TestPathFilterIncludePrefix(t *testing.T) {
+	for _, tt := range []struct {
+		include  []string
+		dir, ext string
+	}{
+		{include: nil},
+		{include: []string{"src/**/*.go"}, dir: "src", ext: "go"},
+		{include: []string{"/cmd/cs/main.go"}, dir: "cmd/cs"},
+		{include: []string{"docs/api/"}, dir: "docs/api"},
+		{include: []string{"*.proto"}, ext: "proto"},
+		{include: []string{"*.pb.go"}},
+		{include: []string{"!*.go"}},
+		{include: []string{"*.go", "*.c"}},
+	} {
+		f, err := NewPathFilter(tt.include, nil)
+		if err != nil {
+			t.Fatalf("NewPathFilter(%q) failed: %v", tt.include, err)
+		}
+		if dir, ext := f.includePrefix(); dir != tt.dir || ext != tt.ext {
+			t.Errorf("includePrefix(%q) = %q, %q, want %q, %q", tt.include, dir, ext, tt.dir, tt.ext)
+		}
+	}
+}
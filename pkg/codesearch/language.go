@@ -0,0 +1,137 @@
+package codesearch
+
+import (
+	"path"
+	"strings"
+)
+
+// Language describes how to recognize the files of a programming language.
+type Language struct {
+	// Name is the name used in the lang qualifier and in Result.Language.
+	Name string
+	// Aliases are other names accepted by the lang qualifier.
+	Aliases []string
+	// GithubName is the value of GitHub's language qualifier.
+	GithubName string
+	// Extensions are the file extensions of the language, with the dot.
+	Extensions []string
+	// Filenames are well-known file names of the language.
+	Filenames []string
+	// Interpreters are the interpreters that appear in the shebang line of
+	// the scripts in the language.
+	Interpreters []string
+}
+
+// languages is the built-in language table, shared by all the backends.
+var languages = []Language{
+	{Name: "c", GithubName: "c", Extensions: []string{".c", ".h"}},
+	{Name: "c++", Aliases: []string{"cpp", "cxx"}, GithubName: "cpp", Extensions: []string{".cc", ".cpp", ".cxx", ".hh", ".hpp", ".hxx"}},
+	{Name: "c#", Aliases: []string{"csharp"}, GithubName: "csharp", Extensions: []string{".cs"}},
+	{Name: "css", GithubName: "css", Extensions: []string{".css"}},
+	{Name: "dockerfile", Aliases: []string{"docker"}, GithubName: "dockerfile", Extensions: []string{".dockerfile"}, Filenames: []string{"Dockerfile", "Containerfile"}},
+	{Name: "go", Aliases: []string{"golang"}, GithubName: "go", Extensions: []string{".go"}},
+	{Name: "html", GithubName: "html", Extensions: []string{".html", ".htm"}},
+	{Name: "java", GithubName: "java", Extensions: []string{".java"}},
+	{Name: "javascript", Aliases: []string{"js"}, GithubName: "javascript", Extensions: []string{".js", ".mjs", ".cjs", ".jsx"}, Interpreters: []string{"node"}},
+	{Name: "json", GithubName: "json", Extensions: []string{".json"}},
+	{Name: "kotlin", GithubName: "kotlin", Extensions: []string{".kt", ".kts"}},
+	{Name: "makefile", Aliases: []string{"make"}, GithubName: "makefile", Extensions: []string{".mk", ".mak"}, Filenames: []string{"Makefile", "GNUmakefile", "makefile"}, Interpreters: []string{"make"}},
+	{Name: "markdown", Aliases: []string{"md"}, GithubName: "markdown", Extensions: []string{".md", ".markdown"}},
+	{Name: "perl", GithubName: "perl", Extensions: []string{".pl", ".pm"}, Interpreters: []string{"perl"}},
+	{Name: "php", GithubName: "php", Extensions: []string{".php"}, Interpreters: []string{"php"}},
+	{Name: "proto", Aliases: []string{"protobuf"}, GithubName: "protobuf", Extensions: []string{".proto"}},
+	{Name: "python", Aliases: []string{"py"}, GithubName: "python", Extensions: []string{".py", ".pyi"}, Interpreters: []string{"python", "python2", "python3"}},
+	{Name: "ruby", Aliases: []string{"rb"}, GithubName: "ruby", Extensions: []string{".rb"}, Filenames: []string{"Gemfile", "Rakefile"}, Interpreters: []string{"ruby"}},
+	{Name: "rust", Aliases: []string{"rs"}, GithubName: "rust", Extensions: []string{".rs"}},
+	{Name: "scala", GithubName: "scala", Extensions: []string{".scala"}},
+	{Name: "shell", Aliases: []string{"sh", "bash"}, GithubName: "shell", Extensions: []string{".sh", ".bash", ".zsh"}, Interpreters: []string{"sh", "bash", "zsh", "dash", "ksh"}},
+	{Name: "sql", GithubName: "sql", Extensions: []string{".sql"}},
+	{Name: "starlark", Aliases: []string{"bazel"}, GithubName: "starlark", Extensions: []string{".bzl", ".star"}, Filenames: []string{"BUILD", "BUILD.bazel", "WORKSPACE", "MODULE.bazel"}},
+	{Name: "swift", GithubName: "swift", Extensions: []string{".swift"}},
+	{Name: "toml", GithubName: "toml", Extensions: []string{".toml"}},
+	{Name: "typescript", Aliases: []string{"ts"}, GithubName: "typescript", Extensions: []string{".ts", ".tsx"}},
+	{Name: "yaml", Aliases: []string{"yml"}, GithubName: "yaml", Extensions: []string{".yml", ".yaml"}},
+}
+
+// LookupLanguage returns the language with the given name or alias, or nil if
+// there is none.
+func LookupLanguage(name string) *Language {
+	name = strings.ToLower(name)
+	for idx, lang := range languages {
+		if lang.Name == name {
+			return &languages[idx]
+		}
+		for _, alias := range lang.Aliases {
+			if alias == name {
+				return &languages[idx]
+			}
+		}
+	}
+	return nil
+}
+
+// Languages returns the names of the languages in the built-in table.
+func Languages() []string {
+	names := make([]string, 0, len(languages))
+	for _, lang := range languages {
+		names = append(names, lang.Name)
+	}
+	return names
+}
+
+// DetectLanguage returns the name of the language of a file, from its name or
+// extension, or from the shebang line at the start of its content. content
+// may be empty, or only contain the first line. It returns an empty string if
+// the language is unknown.
+func DetectLanguage(p, content string) string {
+	base := path.Base(p)
+	ext := strings.ToLower(path.Ext(base))
+	for _, lang := range languages {
+		for _, name := range lang.Filenames {
+			if base == name {
+				return lang.Name
+			}
+		}
+		for _, e := range lang.Extensions {
+			if ext == e {
+				return lang.Name
+			}
+		}
+	}
+	if interpreter := shebangInterpreter(content); interpreter != "" {
+		for _, lang := range languages {
+			for _, i := range lang.Interpreters {
+				if interpreter == i {
+					return lang.Name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// shebangInterpreter returns the name of the interpreter in the shebang line
+// of a script, e.g. "python3" for "#!/usr/bin/env python3", or an empty
+// string if there is no shebang line.
+func shebangInterpreter(content string) string {
+	if !strings.HasPrefix(content, "#!") {
+		return ""
+	}
+	line, _, _ := strings.Cut(content[2:], "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		// skip the options of env, e.g. "#!/usr/bin/env -S python3 -u"
+		interpreter = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				interpreter = f
+				break
+			}
+		}
+	}
+	return interpreter
+}
@@ -0,0 +1,148 @@
+package codesearch
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+)
+
+// minLiteralLength is the length of the shortest literal string that is worth
+// sending to a backend. Shorter strings match almost every file.
+const minLiteralLength = 3
+
+// regexpLiterals returns a boolean expression of the literal strings that any
+// match of the regexp must contain, or nil if there is no such string. This is
+// similar to what index.RegexpQuery does with trigrams.
+func regexpLiterals(re *syntax.Regexp) *Expr {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if len(string(re.Rune)) < minLiteralLength {
+			return nil
+		}
+		return &Expr{Op: ExprPattern, Pattern: string(re.Rune), Kind: PatternLiteral}
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexpLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min < 1 {
+			return nil
+		}
+		return regexpLiterals(re.Sub[0])
+	case syntax.OpConcat:
+		var (
+			all []*Expr
+			run []rune
+		)
+		flush := func() {
+			if e := regexpLiterals(&syntax.Regexp{Op: syntax.OpLiteral, Rune: run}); e != nil {
+				all = append(all, e)
+			}
+			run = nil
+		}
+		for _, sub := range re.Sub {
+			// merge the adjacent literals, which the parser may have split
+			// because of different flags
+			if sub.Op == syntax.OpLiteral {
+				run = append(run, sub.Rune...)
+				continue
+			}
+			flush()
+			if e := regexpLiterals(sub); e != nil {
+				all = append(all, e)
+			}
+		}
+		flush()
+		return combineAll(ExprAnd, all)
+	case syntax.OpAlternate:
+		var all []*Expr
+		for _, sub := range re.Sub {
+			e := regexpLiterals(sub)
+			if e == nil {
+				// this branch can match without any literal
+				return nil
+			}
+			all = append(all, e)
+		}
+		return combineAll(ExprOr, all)
+	default:
+		return nil
+	}
+}
+
+// combineAll combines the expressions with the given operator, or returns nil
+// if there are none.
+func combineAll(op ExprOp, exprs []*Expr) *Expr {
+	if len(exprs) == 0 {
+		return nil
+	}
+	e := exprs[0]
+	for _, sub := range exprs[1:] {
+		e = combine(op, e, sub)
+	}
+	return e
+}
+
+// literalQuery prepares a regexp query for a backend that can only search
+// text. It returns the regexp to verify the results with, and a query for the
+// literal strings that the matches must contain, which finds a superset of the
+// matching files. The results of the literal query must be matched again with
+// the regexp on the full file content, which also yields exact highlights.
+func literalQuery(q *Query, caps Capabilities, opts SearchOptions) (*Query, *regexp.Regexp, error) {
+	pattern := "(?m)" + q.Pattern
+	if opts.WordRegexp {
+		pattern = "(?m)" + wordPattern(q.Pattern)
+	}
+	if opts.CaseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to compile regexp: %w", ErrInvalidQuery, err)
+	}
+	tree, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to parse regexp: %w", ErrInvalidQuery, err)
+	}
+	literals := regexpLiterals(tree.Simplify())
+	if literals == nil {
+		return nil, nil, fmt.Errorf("%w: regexp %q contains no literal text of at least %d characters to search for", ErrUnsupported, q.Pattern, minLiteralLength)
+	}
+	lq := *q
+	lq.Kind = PatternLiteral
+	switch {
+	case literals.Op == ExprPattern:
+		lq.Pattern = literals.Pattern
+	case caps.Boolean && literals.isFlat():
+		lq.Pattern = ""
+		lq.Bool = literals
+	default:
+		// only keep the literals that are always required, the longest one
+		// if the backend cannot combine them
+		var required []*Expr
+		if literals.Op == ExprAnd {
+			for _, sub := range literals.Subs {
+				if sub.Op == ExprPattern {
+					required = append(required, sub)
+				}
+			}
+		}
+		if len(required) == 0 {
+			return nil, nil, fmt.Errorf("%w: regexp %q has alternatives that cannot be searched as text", ErrUnsupported, q.Pattern)
+		}
+		if caps.Boolean {
+			lq.Pattern = ""
+			lq.Bool = combineAll(ExprAnd, required)
+			break
+		}
+		longest := required[0]
+		for _, r := range required[1:] {
+			if len(r.Pattern) > len(longest.Pattern) {
+				longest = r
+			}
+		}
+		lq.Pattern = longest.Pattern
+	}
+	if lq.Bool != nil && lq.Bool.Op == ExprPattern {
+		lq.Pattern, lq.Bool = lq.Bool.Pattern, nil
+	}
+	return &lq, re, nil
+}
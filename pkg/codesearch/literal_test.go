@@ -0,0 +1,77 @@
+package codesearch
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLiteralQuery(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		pattern string
+		boolean bool
+		opts    SearchOptions
+		// want is the literal query, as returned by Query.String
+		want    string
+		wantErr error
+	}{
+		{name: "literal", pattern: `foobar`, want: `"foobar"`},
+		{name: "concat boolean", pattern: `foo\d+bar`, boolean: true, want: `"foo" AND "bar"`},
+		{name: "concat", pattern: `foo\d+bar`, want: `"foo"`},
+		{name: "concat longest", pattern: `ab\d+cdef\s+ghi`, want: `"cdef"`},
+		{name: "short parts dropped", pattern: `ab\d+cdef`, boolean: true, want: `"cdef"`},
+		{name: "capture and plus", pattern: `(func)+ \w+\(ctx`, boolean: true, want: `"func" AND "(ctx"`},
+		{name: "repeat", pattern: `(abc){2,3}`, want: `"abc"`},
+		{name: "alternation boolean", pattern: `foo|barbaz`, boolean: true, want: `"foo" OR "barbaz"`},
+		{name: "alternation", pattern: `foo|barbaz`, wantErr: ErrUnsupported},
+		{name: "nested alternation boolean", pattern: `(foo|bar)baz`, boolean: true, want: `"baz"`},
+		{name: "nested alternation", pattern: `(foo|bar)bazqux`, want: `"bazqux"`},
+		{name: "short alternative", pattern: `a|bc`, boolean: true, wantErr: ErrUnsupported},
+		{name: "optional", pattern: `(foo)?bar`, want: `"bar"`},
+		{name: "only optional", pattern: `(foo)?ba`, wantErr: ErrUnsupported},
+		{name: "star", pattern: `(foobar)*`, wantErr: ErrUnsupported},
+		{name: "only a repetition", pattern: `x+`, wantErr: ErrUnsupported},
+		{name: "too short", pattern: `ab`, wantErr: ErrUnsupported},
+		{name: "only classes", pattern: `\w+\(`, wantErr: ErrUnsupported},
+		{name: "word regexp", pattern: `foo`, opts: SearchOptions{WordRegexp: true}, want: `"foo"`},
+		{name: "invalid", pattern: `foo(`, wantErr: ErrInvalidQuery},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Query{Pattern: tt.pattern, Kind: PatternRegexp}
+			lq, re, err := literalQuery(q, Capabilities{Boolean: tt.boolean}, tt.opts)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("literalQuery(%q) error = %v, want %v", tt.pattern, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("literalQuery(%q) failed: %v", tt.pattern, err)
+			}
+			if got := lq.String(); got != tt.want {
+				t.Errorf("literalQuery(%q) = %s, want %s", tt.pattern, got, tt.want)
+			}
+			if re == nil {
+				t.Errorf("literalQuery(%q) returned no regexp", tt.pattern)
+			}
+		})
+	}
+}
+
+func TestLiteralQueryVerifies(t *testing.T) {
+	q := &Query{Pattern: `foo\d+bar`, Kind: PatternRegexp}
+	_, re, err := literalQuery(q, Capabilities{}, SearchOptions{CaseInsensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for text, want := range map[string]bool{
+		"foo12bar":   true,
+		"FOO1BAR":    true,
+		"foobar":     false,
+		"x\nfoo3bar": true,
+	} {
+		if got := re.MatchString(text); got != want {
+			t.Errorf("regexp %s matches %q: %v, want %v", re, text, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package codesearch
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// wordPattern restricts a regexp to matches that start and end at word
+// boundaries.
+func wordPattern(pattern string) string {
+	return `\b(?:` + pattern + `)\b`
+}
+
+// matchContent finds all the matches of re in the content of a file, and
+// returns them as results with the matched lines, their positions, highlights
+// and context. Matches that share at least one line are merged into the same
+// result, so a result can span multiple lines. Only the fields describing the
+// match are set, the caller has to fill in the rest.
+func matchContent(content string, re *regexp.Regexp, opts SearchOptions) Results {
+	matches := re.FindAllStringIndex(content, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	lines := strings.Split(content, "\n")
+	// offsets of the start of each line in the content
+	lineStarts := make([]int, len(lines))
+	offset := 0
+	for idx, line := range lines {
+		lineStarts[idx] = offset
+		offset += len(line) + 1
+	}
+	// lineOf returns the 0-based index of the line containing the given offset
+	lineOf := func(off int) int {
+		return sort.Search(len(lineStarts), func(i int) bool { return lineStarts[i] > off }) - 1
+	}
+
+	var (
+		results          Results
+		cur              *Result
+		curFirst, curEnd int
+	)
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		cur.Lines = lines[curFirst : curEnd+1]
+		beforeIdx := max(0, curFirst-opts.LinesBefore)
+		afterIdx := min(len(lines), curEnd+1+opts.LinesAfter)
+		cur.Context = ResultContext{
+			Before: lines[beforeIdx:curFirst],
+			After:  lines[curEnd+1 : afterIdx],
+		}
+		results = append(results, *cur)
+		cur = nil
+	}
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		first := lineOf(start)
+		last := first
+		if end > start {
+			// the last matched byte may be a newline, which belongs to the
+			// line it terminates
+			last = lineOf(end - 1)
+		}
+		if cur != nil && first > curEnd {
+			flush()
+		}
+		if cur == nil {
+			cur = &Result{
+				Start: Position{Line: first + 1, Column: start - lineStarts[first] + 1},
+			}
+			curFirst, curEnd = first, last
+		}
+		curEnd = max(curEnd, last)
+		// the end column can't go past the end of the line, even when the
+		// match includes the trailing newline
+		endCol := min(end-lineStarts[last], len(lines[last]))
+		cur.End = Position{Line: last + 1, Column: endCol + 1}
+		for l := first; l <= last; l++ {
+			hlStart := max(start, lineStarts[l]) - lineStarts[l]
+			hlEnd := min(end-lineStarts[l], len(lines[l]))
+			if hlEnd <= hlStart && end > start {
+				// the match only covers the newline of this line
+				continue
+			}
+			cur.Highlights = append(cur.Highlights, Range{Line: l - curFirst, Start: hlStart, End: hlEnd})
+		}
+	}
+	flush()
+	return results
+}
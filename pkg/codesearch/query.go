@@ -0,0 +1,566 @@
+package codesearch
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// PatternKind describes how the pattern of a query is interpreted.
+type PatternKind int
+
+const (
+	// PatternDefault leaves the interpretation to the backend: csearch
+	// treats it as a regular expression, GitHub and GitLab as literal text.
+	PatternDefault PatternKind = iota
+	// PatternLiteral is matched as literal text on every backend.
+	PatternLiteral
+	// PatternRegexp is matched as an RE2 regular expression on every
+	// backend.
+	PatternRegexp
+)
+
+// CaseMode describes the case sensitivity requested in a query.
+type CaseMode int
+
+const (
+	// CaseDefault uses SearchOptions.CaseInsensitive.
+	CaseDefault CaseMode = iota
+	// CaseSensitive is requested with "case:yes".
+	CaseSensitive
+	// CaseInsensitive is requested with "case:no".
+	CaseInsensitive
+	// CaseSmart is requested with "case:auto". The search is
+	// case-insensitive, unless the pattern contains upper-case letters.
+	CaseSmart
+)
+
+// Names of the qualifiers supported in queries.
+const (
+	QualifierRepo = "repo"
+	QualifierPath = "path"
+	QualifierLang = "lang"
+	QualifierCase = "case"
+)
+
+// Query is a backend-agnostic search query. It is made of a pattern, or a
+// boolean expression of patterns, and of optional qualifiers, and is parsed
+// with ParseQuery. Each backend translates it to its native query syntax. The
+// qualifiers that a backend cannot express are applied client-side by Emulate.
+//
+// Qualifiers of the same kind are OR-ed, qualifiers of different kinds are
+// AND-ed.
+type Query struct {
+	Pattern string
+	Kind    PatternKind
+	// Repos restricts the search to repositories whose name, or owner/name,
+	// is one of these
+	Repos []string
+	// Paths restricts the search to files whose path contains one of these
+	Paths []string
+	// Langs restricts the search to files written in one of these languages
+	Langs []string
+	Case  CaseMode
+	// Bool is set for queries that combine several patterns with boolean
+	// operators. Pattern and Kind are empty then.
+	Bool *Expr
+}
+
+// ParseQuery parses a query. The syntax is:
+//
+//   - bare words are a pattern, interpreted natively by each backend.
+//     Adjacent bare words are joined with a single space;
+//   - "quoted text" is a literal pattern, with \" and \\ as escapes;
+//   - /text/ is a regular expression pattern, with \/ as escape. The closing
+//     slash must end the word, so other words starting with a slash, like
+//     /usr/bin/env, are bare words;
+//   - patterns can be combined with AND, OR, NOT and parentheses. NOT binds
+//     tighter than AND, which binds tighter than OR. Patterns without an
+//     operator between them are AND-ed, except adjacent bare words, so
+//     `import "fmt"` is `import AND "fmt"`. A leading "-" before a quoted
+//     pattern, a regexp or a parenthesis is a NOT;
+//   - repo:NAME, path:TEXT, lang:NAME restrict the files to search;
+//   - case:yes, case:no, case:auto set the case sensitivity.
+//
+// Any other word containing a colon is part of a pattern, so backend-specific
+// qualifiers are passed through unchanged. In queries with boolean operators,
+// parentheses at the start and at the end of bare words are used for
+// grouping, so patterns containing parentheses have to be quoted.
+func ParseQuery(s string) (*Query, error) {
+	var q Query
+	toks, err := q.tokenize(s, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, tok := range toks {
+		if tok.kind == tokAnd || tok.kind == tokOr || tok.kind == tokNot || tok.kind == tokMinus {
+			// tokenize again, splitting the grouping parentheses
+			q = Query{}
+			if toks, err = q.tokenize(s, true); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("%w: empty pattern", ErrInvalidQuery)
+	}
+	p := parser{toks: toks}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, p.toks[p.pos].text)
+	}
+	if expr.Op == ExprPattern {
+		q.Pattern, q.Kind = expr.Pattern, expr.Kind
+	} else {
+		q.Bool = expr
+	}
+	return &q, nil
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokLiteral
+	tokRegexp
+	tokAnd
+	tokOr
+	tokNot
+	tokMinus
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// tokenize splits a query into tokens, and parses the qualifiers into q. If
+// splitParens is true, parentheses at the start and at the end of words are
+// returned as separate tokens.
+func (q *Query) tokenize(s string, splitParens bool) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '-' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '(' || isRegexp(s[i+1:])):
+			toks = append(toks, token{kind: tokMinus, text: "-"})
+			i++
+		case splitParens && c == '(':
+			toks = append(toks, token{kind: tokLParen, text: "("})
+			i++
+		case splitParens && c == ')':
+			toks = append(toks, token{kind: tokRParen, text: ")"})
+			i++
+		case c == '"' || isRegexp(s[i:]):
+			text, n, err := parseDelimited(s[i:], c)
+			if err != nil {
+				return nil, err
+			}
+			kind := tokLiteral
+			if c == '/' {
+				kind = tokRegexp
+			}
+			toks = append(toks, token{kind: kind, text: text})
+			i += n
+		default:
+			end := strings.IndexAny(s[i:], " \t\n")
+			if end == -1 {
+				end = len(s) - i
+			}
+			word := s[i : i+end]
+			i += end
+			var closing int
+			if splitParens {
+				for strings.HasSuffix(word, ")") {
+					word = word[:len(word)-1]
+					closing++
+				}
+			}
+			switch word {
+			case "AND":
+				toks = append(toks, token{kind: tokAnd, text: word})
+			case "OR":
+				toks = append(toks, token{kind: tokOr, text: word})
+			case "NOT":
+				toks = append(toks, token{kind: tokNot, text: word})
+			case "":
+			default:
+				ok, err := q.parseQualifier(word)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					toks = append(toks, token{kind: tokWord, text: word})
+				}
+			}
+			for ; closing > 0; closing-- {
+				toks = append(toks, token{kind: tokRParen, text: ")"})
+			}
+		}
+	}
+	return toks, nil
+}
+
+// parser is a recursive-descent parser for boolean expressions of patterns.
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.toks) {
+		return token{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *parser) parseOr() (*Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind != tokOr {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = combine(ExprOr, left, right)
+	}
+}
+
+func (p *parser) parseAnd() (*Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind == tokOr || tok.kind == tokRParen {
+			return left, nil
+		}
+		if tok.kind == tokAnd {
+			p.pos++
+		}
+		// no operator means AND
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = combine(ExprAnd, left, right)
+	}
+}
+
+func (p *parser) parseUnary() (*Expr, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected end of query", ErrInvalidQuery)
+	}
+	switch tok.kind {
+	case tokNot, tokMinus:
+		p.pos++
+		sub, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{Op: ExprNot, Subs: []*Expr{sub}}, nil
+	default:
+		return p.parsePrimary()
+	}
+}
+
+func (p *parser) parsePrimary() (*Expr, error) {
+	tok, _ := p.peek()
+	p.pos++
+	switch tok.kind {
+	case tokLParen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing, ok := p.peek(); !ok || closing.kind != tokRParen {
+			return nil, fmt.Errorf("%w: missing closing parenthesis", ErrInvalidQuery)
+		}
+		p.pos++
+		return expr, nil
+	case tokLiteral:
+		return &Expr{Op: ExprPattern, Pattern: tok.text, Kind: PatternLiteral}, nil
+	case tokRegexp:
+		return &Expr{Op: ExprPattern, Pattern: tok.text, Kind: PatternRegexp}, nil
+	case tokWord:
+		// adjacent bare words are a single pattern
+		words := []string{tok.text}
+		for {
+			next, ok := p.peek()
+			if !ok || next.kind != tokWord {
+				break
+			}
+			words = append(words, next.text)
+			p.pos++
+		}
+		return &Expr{Op: ExprPattern, Pattern: strings.Join(words, " "), Kind: PatternDefault}, nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, tok.text)
+	}
+}
+
+// parseDelimited parses text enclosed between two delimiters at the start of
+// s, and returns the unescaped text and the number of bytes consumed.
+func parseDelimited(s string, delim byte) (string, int, error) {
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == delim || (delim == '"' && s[i+1] == '\\')):
+			sb.WriteByte(s[i+1])
+			i++
+		case s[i] == delim:
+			return sb.String(), i + 1, nil
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("%w: missing closing %c", ErrInvalidQuery, delim)
+}
+
+// isRegexp returns true if s starts with a /regexp/ whose closing slash is
+// followed by a space, a closing parenthesis or the end of the query.
+func isRegexp(s string) bool {
+	if !strings.HasPrefix(s, "/") {
+		return false
+	}
+	_, n, err := parseDelimited(s, '/')
+	return err == nil && (n == len(s) || strings.IndexByte(" \t\n)", s[n]) >= 0)
+}
+
+// parseQualifier parses a qualifier into the query. It returns false if the
+// word is not a known qualifier.
+func (q *Query) parseQualifier(word string) (bool, error) {
+	name, value, ok := strings.Cut(word, ":")
+	if !ok {
+		return false, nil
+	}
+	switch name {
+	case QualifierRepo, QualifierPath, QualifierLang, QualifierCase:
+		if value == "" {
+			return false, fmt.Errorf("%w: empty value for %s", ErrInvalidQuery, name)
+		}
+	default:
+		return false, nil
+	}
+	switch name {
+	case QualifierRepo:
+		q.Repos = append(q.Repos, value)
+	case QualifierPath:
+		q.Paths = append(q.Paths, value)
+	case QualifierLang:
+		if err := q.AddLangs(strings.Split(value, ",")...); err != nil {
+			return false, err
+		}
+	case QualifierCase:
+		switch value {
+		case "yes":
+			q.Case = CaseSensitive
+		case "no":
+			q.Case = CaseInsensitive
+		case "auto":
+			q.Case = CaseSmart
+		default:
+			return false, fmt.Errorf("%w: invalid value %q for case, must be one of yes, no, auto", ErrInvalidQuery, value)
+		}
+	}
+	return true, nil
+}
+
+// String returns the query in the syntax accepted by ParseQuery.
+func (q *Query) String() string {
+	pattern := formatPattern(q.Pattern, q.Kind)
+	if q.Bool != nil {
+		pattern = q.Bool.String()
+	}
+	if qualifiers := q.qualifiersString(); qualifiers != "" {
+		return pattern + " " + qualifiers
+	}
+	return pattern
+}
+
+// qualifiersString returns the qualifiers of the query in the syntax accepted
+// by ParseQuery.
+func (q *Query) qualifiersString() string {
+	var parts []string
+	for _, r := range q.Repos {
+		parts = append(parts, QualifierRepo+":"+r)
+	}
+	for _, p := range q.Paths {
+		parts = append(parts, QualifierPath+":"+p)
+	}
+	if len(q.Langs) > 0 {
+		parts = append(parts, QualifierLang+":"+strings.Join(q.Langs, ","))
+	}
+	switch q.Case {
+	case CaseSensitive:
+		parts = append(parts, QualifierCase+":yes")
+	case CaseInsensitive:
+		parts = append(parts, QualifierCase+":no")
+	case CaseSmart:
+		parts = append(parts, QualifierCase+":auto")
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatPattern returns a pattern in the syntax accepted by ParseQuery.
+func formatPattern(pattern string, kind PatternKind) string {
+	switch kind {
+	case PatternLiteral:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(pattern) + `"`
+	case PatternRegexp:
+		return "/" + strings.ReplaceAll(pattern, "/", `\/`) + "/"
+	default:
+		return pattern
+	}
+}
+
+// terms returns all the patterns of the query, separated by spaces.
+func (q *Query) terms() string {
+	if q.Bool == nil {
+		return q.Pattern
+	}
+	var patterns []string
+	for _, leaf := range q.Bool.leaves() {
+		patterns = append(patterns, leaf.Pattern)
+	}
+	return strings.Join(patterns, " ")
+}
+
+// SetDefaultKind sets the kind of the patterns that have none, i.e. the ones
+// that are neither quoted nor between slashes.
+func (q *Query) SetDefaultKind(kind PatternKind) {
+	if q.Bool == nil {
+		if q.Kind == PatternDefault {
+			q.Kind = kind
+		}
+		return
+	}
+	for _, leaf := range q.Bool.leaves() {
+		if leaf.Kind == PatternDefault {
+			leaf.Kind = kind
+		}
+	}
+}
+
+// leafQuery returns a query for a single pattern of a boolean query, with the
+// same qualifiers.
+func (q *Query) leafQuery(leaf *Expr) *Query {
+	lq := *q
+	lq.Bool = nil
+	lq.Pattern, lq.Kind = leaf.Pattern, leaf.Kind
+	return &lq
+}
+
+// caseInsensitive returns whether the query has to be matched
+// case-insensitively, given the default from the search options.
+func (q *Query) caseInsensitive(def bool) bool {
+	switch q.Case {
+	case CaseSensitive:
+		return false
+	case CaseInsensitive:
+		return true
+	case CaseSmart:
+		return !hasUpper(q.terms())
+	default:
+		return def
+	}
+}
+
+func hasUpper(s string) bool {
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchRepo returns true if a repository, identified by owner and name,
+// satisfies the repo qualifiers. Local repositories have no owner, and their
+// name is a path, which matches if it ends with the qualifier's value.
+func (q *Query) MatchRepo(owner, name string) bool {
+	if len(q.Repos) == 0 {
+		return true
+	}
+	for _, r := range q.Repos {
+		switch {
+		case strings.EqualFold(r, name),
+			owner != "" && strings.EqualFold(r, owner+"/"+name),
+			owner == "" && strings.HasSuffix(strings.ToLower(name), "/"+strings.ToLower(strings.TrimPrefix(r, "/"))):
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPath returns true if a file path satisfies the path and lang
+// qualifiers. The language is only detected from the file name.
+func (q *Query) MatchPath(p string) bool {
+	return q.matchPaths(p) && q.MatchLang(DetectLanguage(p, ""))
+}
+
+// matchPaths returns true if a file path satisfies the path qualifiers.
+func (q *Query) matchPaths(p string) bool {
+	if len(q.Paths) == 0 {
+		return true
+	}
+	for _, qp := range q.Paths {
+		if strings.Contains(strings.ToLower(p), strings.ToLower(qp)) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchLang returns true if a file in the given language, as returned by
+// DetectLanguage, satisfies the lang qualifiers.
+func (q *Query) MatchLang(lang string) bool {
+	if len(q.Langs) == 0 {
+		return true
+	}
+	for _, l := range q.Langs {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// AddLangs adds languages to the lang qualifiers, e.g. from a command line
+// flag. Aliases are replaced by the name of the language.
+func (q *Query) AddLangs(langs ...string) error {
+	for _, name := range langs {
+		lang := LookupLanguage(strings.TrimSpace(name))
+		if lang == nil {
+			return fmt.Errorf("%w: unknown language %q", ErrInvalidQuery, name)
+		}
+		q.Langs = append(q.Langs, lang.Name)
+	}
+	return nil
+}
+
+// MatchResult returns true if a result satisfies all the qualifiers.
+func (q *Query) MatchResult(res *Result) bool {
+	lang := res.Language
+	if lang == "" {
+		lang = DetectLanguage(res.Path, "")
+	}
+	return q.MatchRepo(res.Owner, res.RepoName) && q.matchPaths(res.Path) && q.MatchLang(lang)
+}
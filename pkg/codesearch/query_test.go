@@ -0,0 +1,234 @@
+package codesearch
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQueryAdjacentPatterns(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  string
+		bool  bool
+	}{
+		{query: `foo bar`, want: `foo bar`},
+		{query: `foo   bar  baz`, want: `foo bar baz`},
+		{query: `"foo bar"`, want: `"foo bar"`},
+		{query: `/ba+r/`, want: `/ba+r/`},
+		{query: `import "fmt"`, want: `import AND "fmt"`, bool: true},
+		{query: `"import \"fmt\""`, want: `"import \"fmt\""`},
+		{query: `foo /ba+r/`, want: `foo AND /ba+r/`, bool: true},
+		{query: `foo bar "baz" qux`, want: `foo bar AND "baz" AND qux`, bool: true},
+		{query: `"a" "b"`, want: `"a" AND "b"`, bool: true},
+		{query: `/a/ /b/`, want: `/a/ AND /b/`, bool: true},
+		{query: `"a" /b/ c d`, want: `"a" AND /b/ AND c d`, bool: true},
+		{query: `foo bar OR baz`, want: `foo bar OR baz`, bool: true},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery(%q) failed: %v", tt.query, err)
+			}
+			if got := q.String(); got != tt.want {
+				t.Errorf("ParseQuery(%q) = %s, want %s", tt.query, got, tt.want)
+			}
+			if got := q.Bool != nil; got != tt.bool {
+				t.Errorf("ParseQuery(%q) is boolean: %v, want %v", tt.query, got, tt.bool)
+			}
+		})
+	}
+}
+
+func TestParseQueryQualifiers(t *testing.T) {
+	for _, tt := range []struct {
+		query   string
+		pattern string
+		kind    PatternKind
+		repos   []string
+		paths   []string
+		langs   []string
+		mode    CaseMode
+	}{
+		{query: `foo`, pattern: `foo`},
+		{query: `"foo"`, pattern: `foo`, kind: PatternLiteral},
+		{query: `/fo+/`, pattern: `fo+`, kind: PatternRegexp},
+		{query: `/a\/b/`, pattern: `a/b`, kind: PatternRegexp},
+		{query: `"a \"b\" \\"`, pattern: `a "b" \`, kind: PatternLiteral},
+		{query: `/usr/bin/env foo`, pattern: `/usr/bin/env foo`},
+		{query: `foo repo:a repo:owner/b`, pattern: `foo`, repos: []string{"a", "owner/b"}},
+		{query: `path:cmd/ foo path:pkg`, pattern: `foo`, paths: []string{"cmd/", "pkg"}},
+		{query: `lang:go foo`, pattern: `foo`, langs: []string{"go"}},
+		{query: `lang:golang,Python,cpp foo`, pattern: `foo`, langs: []string{"go", "python", "c++"}},
+		{query: `foo lang:go lang:js`, pattern: `foo`, langs: []string{"go", "javascript"}},
+		{query: `case:yes foo`, pattern: `foo`, mode: CaseSensitive},
+		{query: `case:no foo`, pattern: `foo`, mode: CaseInsensitive},
+		{query: `case:auto foo`, pattern: `foo`, mode: CaseSmart},
+		{query: `foo case:no case:yes`, pattern: `foo`, mode: CaseSensitive},
+		// unknown qualifiers are passed through to the backend
+		{query: `in:path foo`, pattern: `in:path foo`},
+		{query: `foo org:x http://example.com`, pattern: `foo org:x http://example.com`},
+		{query: `Repo:x foo`, pattern: `Repo:x foo`},
+		// qualifiers between words do not split the pattern
+		{query: `foo repo:a bar`, pattern: `foo bar`, repos: []string{"a"}},
+		// without boolean operators, parentheses are part of the pattern
+		{query: `foo)`, pattern: `foo)`},
+		{query: `(a`, pattern: `(a`},
+		{query: `foo()`, pattern: `foo()`},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery(%q) failed: %v", tt.query, err)
+			}
+			if q.Bool != nil {
+				t.Fatalf("ParseQuery(%q) = %s, want a single pattern", tt.query, q)
+			}
+			if q.Pattern != tt.pattern || q.Kind != tt.kind {
+				t.Errorf("ParseQuery(%q) pattern = %q (kind %d), want %q (kind %d)", tt.query, q.Pattern, q.Kind, tt.pattern, tt.kind)
+			}
+			if !reflect.DeepEqual(q.Repos, tt.repos) {
+				t.Errorf("ParseQuery(%q) repos = %q, want %q", tt.query, q.Repos, tt.repos)
+			}
+			if !reflect.DeepEqual(q.Paths, tt.paths) {
+				t.Errorf("ParseQuery(%q) paths = %q, want %q", tt.query, q.Paths, tt.paths)
+			}
+			if !reflect.DeepEqual(q.Langs, tt.langs) {
+				t.Errorf("ParseQuery(%q) langs = %q, want %q", tt.query, q.Langs, tt.langs)
+			}
+			if q.Case != tt.mode {
+				t.Errorf("ParseQuery(%q) case = %d, want %d", tt.query, q.Case, tt.mode)
+			}
+			// String returns a query that parses to the same query
+			again, err := ParseQuery(q.String())
+			if err != nil {
+				t.Fatalf("ParseQuery(%q) failed: %v", q.String(), err)
+			}
+			if !reflect.DeepEqual(again, q) {
+				t.Errorf("ParseQuery(%q) = %+v, want %+v", q.String(), again, q)
+			}
+		})
+	}
+}
+
+// sexpr returns the expression in prefix notation, to make the structure of
+// the tree explicit.
+func sexpr(e *Expr) string {
+	switch e.Op {
+	case ExprAnd, ExprOr, ExprNot:
+		op := map[ExprOp]string{ExprAnd: "and", ExprOr: "or", ExprNot: "not"}[e.Op]
+		var subs []string
+		for _, sub := range e.Subs {
+			subs = append(subs, sexpr(sub))
+		}
+		return "(" + op + " " + strings.Join(subs, " ") + ")"
+	default:
+		return formatPattern(e.Pattern, e.Kind)
+	}
+}
+
+func TestParseQueryBoolean(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{query: `a AND b`, want: `(and a b)`},
+		{query: `a OR b`, want: `(or a b)`},
+		{query: `NOT a b`, want: `(not a b)`},
+		{query: `a AND b AND c`, want: `(and a b c)`},
+		{query: `a OR b OR c`, want: `(or a b c)`},
+		// NOT binds tighter than AND, which binds tighter than OR
+		{query: `a OR b AND c`, want: `(or a (and b c))`},
+		{query: `a AND b OR c`, want: `(or (and a b) c)`},
+		{query: `NOT a OR b`, want: `(or (not a) b)`},
+		{query: `NOT a AND b`, want: `(and (not a) b)`},
+		{query: `NOT NOT a`, want: `(not (not a))`},
+		// parentheses group
+		{query: `(a OR b) AND c`, want: `(and (or a b) c)`},
+		{query: `a AND (b OR c)`, want: `(and a (or b c))`},
+		{query: `NOT (a OR b)`, want: `(not (or a b))`},
+		{query: `(a OR b) AND (c OR d)`, want: `(and (or a b) (or c d))`},
+		{query: `((a OR b))`, want: `(or a b)`},
+		{query: `(a OR (b AND (c OR d)))`, want: `(or a (and b (or c d)))`},
+		{query: `(a b) OR c`, want: `(or a b c)`},
+		// no operator means AND
+		{query: `"a" "b" OR c`, want: `(or (and "a" "b") c)`},
+		{query: `(a OR b) (c OR d)`, want: `(and (or a b) (or c d))`},
+		// "-" is a NOT before quoted patterns, regexps and parentheses
+		{query: `-"x" foo`, want: `(and (not "x") foo)`},
+		{query: `-/x/ foo`, want: `(and (not /x/) foo)`},
+		{query: `foo -(a OR b)`, want: `(and foo (not (or a b)))`},
+		{query: `-foo OR bar`, want: `(or -foo bar)`},
+		// qualifiers apply to the whole query
+		{query: `a OR b lang:go`, want: `(or a b)`},
+		{query: `(a repo:x) OR b`, want: `(or a b)`},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery(%q) failed: %v", tt.query, err)
+			}
+			if q.Bool == nil {
+				t.Fatalf("ParseQuery(%q) = %s, want a boolean query", tt.query, q)
+			}
+			if got := sexpr(q.Bool); got != tt.want {
+				t.Errorf("ParseQuery(%q) = %s, want %s", tt.query, got, tt.want)
+			}
+			if q.Pattern != "" || q.Kind != PatternDefault {
+				t.Errorf("ParseQuery(%q) has pattern %q (kind %d) as well", tt.query, q.Pattern, q.Kind)
+			}
+			// String returns a query that parses to the same tree
+			again, err := ParseQuery(q.String())
+			if err != nil {
+				t.Fatalf("ParseQuery(%q) failed: %v", q.String(), err)
+			}
+			if got := sexpr(again.Bool); got != tt.want {
+				t.Errorf("ParseQuery(%q) = %s, want %s", q.String(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		``,
+		`   `,
+		`repo:x`,
+		`lang:go case:yes`,
+		`NOT`,
+		`NOT NOT`,
+		`a AND NOT`,
+		`a AND`,
+		`a OR`,
+		`OR a`,
+		`AND`,
+		`a OR foo)`,
+		`(a OR b))`,
+		`foo() OR bar`,
+		`(a OR b`,
+		`((a OR b)`,
+		`a AND ()`,
+		`-(a OR b`,
+		`"foo`,
+		`foo "bar`,
+		`"a" OR "b`,
+		`repo:`,
+		`foo path:`,
+		`lang: foo`,
+		`case: foo`,
+		`lang:nope foo`,
+		`lang:go,nope foo`,
+		`lang:go, foo`,
+		`case:maybe foo`,
+		`case:YES foo`,
+		`a OR b lang:nope`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			q, err := ParseQuery(query)
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("ParseQuery(%q) = %v, %v, want %v", query, q, err, ErrInvalidQuery)
+			}
+		})
+	}
+}
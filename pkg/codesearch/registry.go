@@ -0,0 +1,65 @@
+package codesearch
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// BackendFactory creates a backend with the given name and parameters, as
+// found in the configuration file.
+type BackendFactory func(name string, params BackendParams) (Backend, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[BackendType]BackendFactory)
+)
+
+// RegisterBackend makes a backend type available to the configuration. It is
+// meant to be called from an init function, and panics if the factory is nil
+// or if the type is registered twice. The built-in backends register
+// themselves this way, and so can backends defined outside of this package.
+func RegisterBackend(t BackendType, factory BackendFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic(fmt.Sprintf("codesearch: nil factory for backend type %q", t))
+	}
+	if _, ok := registry[t]; ok {
+		panic(fmt.Sprintf("codesearch: backend type %q registered twice", t))
+	}
+	registry[t] = factory
+}
+
+// BackendTypes returns the sorted list of the registered backend types.
+func BackendTypes() []BackendType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	types := make([]BackendType, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// IsRegistered returns true if a backend type has been registered with
+// RegisterBackend.
+func IsRegistered(t BackendType) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	_, ok := registry[t]
+	return ok
+}
+
+// NewBackend instantiates the backend described by the given configuration,
+// using the factory registered for its type.
+func NewBackend(name string, config BackendConfig) (Backend, error) {
+	registryMu.RLock()
+	factory, ok := registry[config.Type]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown backend type %q", ErrInvalidConfig, config.Type)
+	}
+	return factory(name, config.Params)
+}
@@ -1,25 +1,159 @@
 package codesearch
 
+import (
+	"iter"
+	"sort"
+)
+
 type Results []Result
 
 type Result struct {
 	Backend string
-	Line    string
-	Lineno  int
+	// Lines are the lines spanned by the match, from Start.Line to End.Line.
+	// Single-line matches have exactly one line.
+	Lines []string
+	// Start is the position of the first matched byte, and End is the
+	// position right after the last matched byte
+	Start Position
+	End   Position
 	// IsFilename is true if the result matches just the file name, and false if
 	// it matches the file content
 	IsFilename bool
 	Context    ResultContext
-	Highlight  [2]int
+	// Highlights are the ranges of Lines that match the search terms, sorted
+	// by line and start offset. Matches spanning multiple lines have one
+	// range per line.
+	Highlights []Range
 	Path       string
 	RepoURL    string
 	FileURL    string
 	Owner      string
 	RepoName   string
 	Branch     string
+	// Language is the language of the file, see DetectLanguage. It is empty
+	// if the language is unknown.
+	Language string
+	// SymbolKind is the kind of the definition matched by a symbol search,
+	// see SearchOptions.Symbol. It is empty for the other searches.
+	SymbolKind SymbolKind
+}
+
+// Position is a position in a file. Both Line and Column are 1-based, and
+// Column is counted in bytes.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// Range is a range of bytes in one of the lines of a result, from Start
+// included to End excluded. Line is the index of the line in Result.Lines.
+type Range struct {
+	Line  int
+	Start int
+	End   int
+}
+
+// Lineno returns the number of the first matched line.
+func (r Result) Lineno() int {
+	return r.Start.Line
+}
+
+// Line returns the first matched line.
+func (r Result) Line() string {
+	if len(r.Lines) == 0 {
+		return ""
+	}
+	return r.Lines[0]
+}
+
+// LineHighlights returns the highlight ranges on the i-th line of Lines.
+func (r Result) LineHighlights(i int) []Range {
+	var highlights []Range
+	for _, hl := range r.Highlights {
+		if hl.Line == i {
+			highlights = append(highlights, hl)
+		}
+	}
+	return highlights
+}
+
+// filenameResult returns a copy of the result that only describes the file,
+// without the matched content.
+func (r Result) filenameResult() Result {
+	return Result{
+		Backend:    r.Backend,
+		IsFilename: true,
+		Path:       r.Path,
+		RepoURL:    r.RepoURL,
+		FileURL:    r.FileURL,
+		Owner:      r.Owner,
+		RepoName:   r.RepoName,
+		Branch:     r.Branch,
+	}
+}
+
+// addHighlight adds a highlight range, keeping the highlights sorted and
+// skipping duplicates.
+func (r *Result) addHighlight(hl Range) {
+	for _, h := range r.Highlights {
+		if h == hl {
+			return
+		}
+	}
+	r.Highlights = append(r.Highlights, hl)
+	sort.Slice(r.Highlights, func(i, j int) bool {
+		if r.Highlights[i].Line != r.Highlights[j].Line {
+			return r.Highlights[i].Line < r.Highlights[j].Line
+		}
+		return r.Highlights[i].Start < r.Highlights[j].Start
+	})
+	r.updateColumns()
+}
+
+// updateColumns sets the columns of Start and End from the first and last
+// highlights on a single-line result.
+func (r *Result) updateColumns() {
+	if len(r.Highlights) == 0 {
+		return
+	}
+	first, last := r.Highlights[0], r.Highlights[len(r.Highlights)-1]
+	r.Start.Column = first.Start + 1
+	r.End.Column = last.End + 1
 }
 
 type ResultContext struct {
 	Before []string
 	After  []string
 }
+
+// All returns an iterator over the results, with the same signature as
+// Backend.Search.
+func (r Results) All() iter.Seq2[Result, error] {
+	return func(yield func(Result, error) bool) {
+		for _, res := range r {
+			if !yield(res, nil) {
+				return
+			}
+		}
+	}
+}
+
+// errorSeq returns an iterator that only emits the given error.
+func errorSeq(err error) iter.Seq2[Result, error] {
+	return func(yield func(Result, error) bool) {
+		yield(Result{}, err)
+	}
+}
+
+// Collect consumes a results iterator and returns all of its results, or the
+// first error encountered.
+func Collect(seq iter.Seq2[Result, error]) (Results, error) {
+	var results Results
+	for res, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
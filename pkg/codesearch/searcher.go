@@ -0,0 +1,386 @@
+package codesearch
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Searcher runs queries across the backends defined in a configuration. It is
+// safe for concurrent use.
+type Searcher struct {
+	config *Config
+
+	mu       sync.Mutex
+	backends map[string]Backend
+}
+
+// NewSearcher validates the configuration and returns a Searcher for it.
+// Backends are instantiated on first use.
+func NewSearcher(config *Config) (*Searcher, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	return &Searcher{
+		config:   config,
+		backends: make(map[string]Backend),
+	}, nil
+}
+
+// Request describes a query to run with a Searcher.
+type Request struct {
+	Query *Query
+	// Backends are the names of the backends to search. If empty, the
+	// default backends from the configuration are used. "all" expands to all
+	// the configured backends.
+	Backends []string
+	Options  SearchOptions
+	// Sort is the sorting method, see NewSorter. If empty, the results are
+	// not sorted.
+	Sort string
+	// Limit is the maximum number of results per backend. 0 means no limit.
+	Limit uint
+	// Timeout is the maximum duration of the search on each backend. If
+	// non-zero, it overrides the timeout of each backend's configuration.
+	Timeout time.Duration
+	// MatchFilename, if not empty, only keeps the results whose path
+	// contains it, case-insensitively.
+	MatchFilename string
+}
+
+// BackendStats describes the search on a single backend.
+type BackendStats struct {
+	Backend  string
+	Duration time.Duration
+	Results  int
+	// Languages is the number of results in each language, see
+	// Result.Language. Results in unknown languages are counted under the
+	// empty string.
+	Languages map[string]int
+	// Warnings describes the search options that the backend does not
+	// support natively, see Emulate.
+	Warnings []error
+	// Err is the error that interrupted the search on this backend, if any.
+	Err error
+}
+
+// Stats describes a search across multiple backends.
+type Stats struct {
+	// Backends has the stats of each backend, in the order of the request.
+	Backends []BackendStats
+	Duration time.Duration
+	Results  int
+	// Languages is the number of results in each language, across all the
+	// backends.
+	Languages map[string]int
+}
+
+// Failed returns the stats of the backends that failed.
+func (s *Stats) Failed() []BackendStats {
+	var failed []BackendStats
+	for _, bs := range s.Backends {
+		if bs.Err != nil {
+			failed = append(failed, bs)
+		}
+	}
+	return failed
+}
+
+// Sorter sorts results in place and returns them.
+type Sorter func(Results) Results
+
+// NewSorter returns the sorter for the given method, which can be "a-z" or
+// "z-a" to sort by path. An empty method returns a sorter that leaves the
+// results untouched.
+func NewSorter(method string) (Sorter, error) {
+	switch method {
+	case "a-z":
+		return func(r Results) Results {
+			sort.SliceStable(r, func(i, j int) bool { return r[i].Path < r[j].Path })
+			return r
+		}, nil
+	case "z-a":
+		return func(r Results) Results {
+			sort.SliceStable(r, func(i, j int) bool { return r[i].Path > r[j].Path })
+			return r
+		}, nil
+	case "":
+		return func(r Results) Results {
+			return r
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: invalid sort method %q", ErrInvalidQuery, method)
+	}
+}
+
+// ResolveBackends returns the names of the backends to search. Empty names
+// resolve to the configuration's default backends, and "all" expands to all
+// the configured backends, sorted by name. Duplicate names are only returned
+// once.
+func (s *Searcher) ResolveBackends(names []string) ([]string, error) {
+	if len(names) == 0 {
+		names = s.config.DefaultBackends
+	}
+	var resolved []string
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if name == "all" {
+			resolved = make([]string, 0, len(s.config.Backends))
+			for bname := range s.config.Backends {
+				resolved = append(resolved, bname)
+			}
+			sort.Strings(resolved)
+			return resolved, nil
+		}
+		if _, ok := s.config.Backends[name]; !ok {
+			return nil, fmt.Errorf("%w: backend %q", ErrNotFound, name)
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		resolved = append(resolved, name)
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("%w: no backends specified", ErrInvalidConfig)
+	}
+	return resolved, nil
+}
+
+// Backend returns the backend with the given name, instantiating it on first
+// use.
+func (s *Searcher) Backend(name string) (Backend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.backends[name]; ok {
+		return b, nil
+	}
+	backendConfig, ok := s.config.Backends[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: backend %q", ErrNotFound, name)
+	}
+	b, err := NewBackend(name, backendConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate backend %q: %w", name, err)
+	}
+	s.backends[name] = b
+	return b, nil
+}
+
+// Search runs the request and returns all the results, sorted as requested
+// across all the backends.
+func (s *Searcher) Search(ctx context.Context, req Request) (Results, *Stats, error) {
+	var results Results
+	stats, err := s.Stream(ctx, req, func(res Result) {
+		results = append(results, res)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sorter, err := NewSorter(req.Sort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sorter(results), stats, nil
+}
+
+// prepare validates a request, and applies the configuration to it.
+func (s *Searcher) prepare(req Request) (Request, error) {
+	if req.Query == nil {
+		return req, fmt.Errorf("%w: missing query", ErrInvalidQuery)
+	}
+	if req.Query.Bool != nil && req.Options.SearchInFilenames {
+		return req, fmt.Errorf("%w: boolean queries cannot search in file names", ErrUnsupported)
+	}
+	if req.Options.Symbol && (req.Query.Bool != nil || req.Options.SearchInFilenames) {
+		return req, fmt.Errorf("%w: symbol search takes a single name, and cannot search in file names", ErrInvalidQuery)
+	}
+	if len(s.config.DefaultExcludes) > 0 {
+		req.Options.Exclude = append(append([]string(nil), s.config.DefaultExcludes...), req.Options.Exclude...)
+	}
+	if _, err := NewPathFilter(req.Options.Include, req.Options.Exclude); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// Explain describes how the request would run on each backend, see Explain.
+// The backends that cannot explain the search have the error in their plan.
+func (s *Searcher) Explain(ctx context.Context, req Request) ([]*Plan, error) {
+	req, err := s.prepare(req)
+	if err != nil {
+		return nil, err
+	}
+	names, err := s.ResolveBackends(req.Backends)
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]*Plan, 0, len(names))
+	for _, name := range names {
+		b, err := s.Backend(name)
+		if err != nil {
+			return nil, err
+		}
+		plan, err := Explain(ctx, b, req.Query, req.Options)
+		if err != nil {
+			plan = &Plan{Backend: b.Name(), Type: b.Type(), Err: err}
+		}
+		if req.MatchFilename != "" {
+			plan.ClientSide = append(plan.ClientSide, fmt.Sprintf("keep the results whose path contains %q", req.MatchFilename))
+		}
+		if req.Limit > 0 {
+			plan.ClientSide = append(plan.ClientSide, fmt.Sprintf("stop after %d results", req.Limit))
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// Stream runs the request on all the backends concurrently, and calls fn for
+// each result as soon as it is available. fn is always called from the
+// calling goroutine. When sorting is requested, the results of each backend
+// are sorted before being passed to fn, which delays them until the backend
+// is done. When searching in file names, the file names are de-duplicated and
+// sorted per backend.
+//
+// Failing backends, including those that cannot be instantiated, do not
+// interrupt the search: their errors are reported in the returned stats. An
+// error is only returned if the request is invalid.
+func (s *Searcher) Stream(ctx context.Context, req Request, fn func(Result)) (*Stats, error) {
+	req, err := s.prepare(req)
+	if err != nil {
+		return nil, err
+	}
+	names, err := s.ResolveBackends(req.Backends)
+	if err != nil {
+		return nil, err
+	}
+	sorter, err := NewSorter(req.Sort)
+	if err != nil {
+		return nil, err
+	}
+	if req.Options.SearchInFilenames && req.Sort == "" {
+		sorter, _ = NewSorter("a-z")
+	}
+
+	// event is sent by the goroutine searching a backend, either with a
+	// result, or with the backend's stats once the search is over
+	type event struct {
+		result Result
+		idx    int
+		stats  *BackendStats
+	}
+	searchStart := time.Now()
+	// the stats of each backend, in the order of names
+	backendStats := make([]BackendStats, len(names))
+	// search all the backends concurrently. The results are passed to fn by
+	// this goroutine as they arrive, so a failing or slow backend does not
+	// hold back the others
+	events := make(chan event)
+	running := 0
+	for idx, name := range names {
+		b, err := s.Backend(name)
+		if err != nil {
+			// a backend that cannot be set up fails alone, like a backend
+			// whose search fails
+			backendStats[idx] = BackendStats{Backend: name, Languages: make(map[string]int), Err: err}
+			continue
+		}
+		running++
+		go func(idx int, b Backend) {
+			start := time.Now()
+			timeout := s.config.Backends[b.Name()].Timeout
+			if req.Timeout > 0 {
+				timeout = req.Timeout
+			}
+			searchCtx, cancel := ctx, context.CancelFunc(func() {})
+			if timeout > 0 {
+				searchCtx, cancel = context.WithTimeout(ctx, timeout)
+			}
+			defer cancel()
+			bs := BackendStats{Backend: b.Name(), Languages: make(map[string]int)}
+			results, warnings := Emulate(searchCtx, b, req.Query, req.Options)
+			bs.Warnings = warnings
+			if req.Sort != "" || req.Options.SearchInFilenames {
+				// sorting needs all the results, so collect them before
+				// emitting anything
+				all, err := Collect(results)
+				if err != nil {
+					bs.Err = err
+					results = nil
+				} else {
+					results = sorter(all).All()
+				}
+			}
+			if results != nil {
+				// file names already emitted, to remove duplicates when
+				// searching in file names
+				seen := make(map[string]struct{})
+				for res, err := range results {
+					if err != nil {
+						bs.Err = err
+						break
+					}
+					if !keepResult(&res, req, seen) {
+						continue
+					}
+					if req.Limit > 0 && uint(bs.Results) >= req.Limit {
+						break
+					}
+					bs.Results++
+					bs.Languages[res.Language]++
+					events <- event{result: res}
+				}
+			}
+			bs.Duration = time.Since(start)
+			events <- event{idx: idx, stats: &bs}
+		}(idx, b)
+	}
+	for running > 0 {
+		ev := <-events
+		if ev.stats != nil {
+			backendStats[ev.idx] = *ev.stats
+			running--
+			continue
+		}
+		fn(ev.result)
+	}
+	stats := Stats{Backends: backendStats, Duration: time.Since(searchStart), Languages: make(map[string]int)}
+	for _, bs := range backendStats {
+		stats.Results += bs.Results
+		for lang, n := range bs.Languages {
+			stats.Languages[lang] += n
+		}
+	}
+	return &stats, nil
+}
+
+// keepResult returns true if the result has to be emitted for the request.
+// seen holds the paths already emitted when searching in file names.
+func keepResult(res *Result, req Request, seen map[string]struct{}) bool {
+	if req.Options.SearchInFilenames {
+		// we are searching the pattern in the file name, only keep each file
+		// name once
+		if !strings.Contains(strings.ToLower(path.Base(res.Path)), strings.ToLower(req.Query.Pattern)) && !res.IsFilename {
+			return false
+		}
+		if _, ok := seen[res.Path]; ok {
+			return false
+		}
+		seen[res.Path] = struct{}{}
+		*res = res.filenameResult()
+		return true
+	}
+	// we are searching the pattern in the file content
+	if res.IsFilename {
+		return false
+	}
+	if req.MatchFilename != "" && !strings.Contains(strings.ToLower(res.Path), strings.ToLower(req.MatchFilename)) {
+		return false
+	}
+	return true
+}
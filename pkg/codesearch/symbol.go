@@ -0,0 +1,302 @@
+package codesearch
+
+import (
+	goast "go/ast"
+	goparser "go/parser"
+	gotoken "go/token"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SymbolKind is the kind of definition of a symbol.
+type SymbolKind string
+
+// Symbol kinds. Classes, structs, interfaces and the like are all types.
+const (
+	SymbolFunc   SymbolKind = "func"
+	SymbolMethod SymbolKind = "method"
+	SymbolType   SymbolKind = "type"
+	SymbolConst  SymbolKind = "const"
+	SymbolVar    SymbolKind = "var"
+)
+
+// Symbol is the definition of a symbol in a file.
+type Symbol struct {
+	Name string
+	Kind SymbolKind
+	// Line is the 1-based number of the line of the definition, and Column
+	// the 1-based byte column of the name on that line.
+	Line   int
+	Column int
+}
+
+// symbolPattern recognizes the definition of a symbol on a single line. The
+// first group of re is the name of the symbol.
+type symbolPattern struct {
+	kind SymbolKind
+	re   *regexp.Regexp
+}
+
+// symbolPatterns are the heuristics that find definitions line by line, like
+// ctags does, by language. They are used for the languages without a parser,
+// and for single lines without the rest of the file. The patterns of each
+// language are tried in order, and the first one that matches wins.
+var symbolPatterns = map[string][]symbolPattern{
+	"go": {
+		{SymbolMethod, regexp.MustCompile(`^func\s*\([^)]*\)\s*(\w+)`)},
+		{SymbolFunc, regexp.MustCompile(`^func\s+(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:type\s+)?(\w+)\s+(?:struct|interface)\b`)},
+		{SymbolType, regexp.MustCompile(`^type\s+(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^const\s+(\w+)`)},
+		{SymbolVar, regexp.MustCompile(`^var\s+(\w+)`)},
+	},
+	"python": {
+		{SymbolFunc, regexp.MustCompile(`^(?:async\s+)?def\s+(\w+)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:async\s+)?def\s+(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*class\s+(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^([A-Z][A-Z0-9_]*)\s*(?::[^=]*)?=[^=]`)},
+	},
+	"javascript": {
+		{SymbolFunc, regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?class\s+(\w+)`)},
+		{SymbolFunc, regexp.MustCompile(`^\s*(?:export\s+)?(?:const|let|var)\s+(\w+)\s*=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*=>|\w+\s*=>)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*(?:export\s+)?const\s+(\w+)\s*=`)},
+	},
+	"typescript": {
+		{SymbolFunc, regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:export\s+)?(?:default\s+)?(?:abstract\s+)?(?:class|interface|enum)\s+(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:export\s+)?type\s+(\w+)\s*(?:<[^>]*>)?\s*=`)},
+		{SymbolFunc, regexp.MustCompile(`^\s*(?:export\s+)?(?:const|let|var)\s+(\w+)\s*(?::[^=]*)?=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*=>|\w+\s*=>)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*(?:export\s+)?const\s+(\w+)\s*(?::[^=]*)?=`)},
+	},
+	"rust": {
+		{SymbolFunc, regexp.MustCompile(`^(?:pub(?:\([^)]*\))?\s+)?(?:const\s+)?(?:async\s+)?(?:unsafe\s+)?(?:extern\s+"[^"]*"\s+)?fn\s+(\w+)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:pub(?:\([^)]*\))?\s+)?(?:const\s+)?(?:async\s+)?(?:unsafe\s+)?fn\s+(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:struct|enum|union|trait|type)\s+(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*(?:pub(?:\([^)]*\))?\s+)?(?:const|static)\s+(?:mut\s+)?(\w+)`)},
+	},
+	"c": {
+		{SymbolConst, regexp.MustCompile(`^\s*#\s*define\s+(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:typedef\s+)?(?:struct|union|enum)\s+(\w+)\s*\{?\s*$`)},
+		{SymbolType, regexp.MustCompile(`^\s*typedef\b.*?\b(\w+)\s*;`)},
+		{SymbolFunc, regexp.MustCompile(`^(?:static\s+|inline\s+|extern\s+)*[A-Za-z_][\w\s\*]*?[\s\*](\w+)\s*\([^;]*$`)},
+	},
+	"c++": {
+		{SymbolConst, regexp.MustCompile(`^\s*#\s*define\s+(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:template\s*<[^>]*>\s*)?(?:class|struct|union|enum(?:\s+class)?)\s+(\w+)\s*(?::[^;]*)?\{?\s*$`)},
+		{SymbolType, regexp.MustCompile(`^\s*using\s+(\w+)\s*=`)},
+		{SymbolMethod, regexp.MustCompile(`^(?:[A-Za-z_][\w:<>\s\*&]*?[\s\*&])?\w+::(~?\w+)\s*\([^;]*$`)},
+		{SymbolFunc, regexp.MustCompile(`^(?:static\s+|inline\s+|extern\s+|constexpr\s+|virtual\s+)*[A-Za-z_][\w:<>\s\*&]*?[\s\*&](\w+)\s*\([^;]*$`)},
+	},
+	"java": {
+		{SymbolType, regexp.MustCompile(`^\s*(?:(?:public|protected|private|static|final|abstract|sealed)\s+)*(?:class|interface|enum|record|@interface)\s+(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*(?:(?:public|protected|private)\s+)?static\s+final\s+[\w<>\[\],\s]+?\s(\w+)\s*=`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:(?:public|protected|private|static|final|abstract|synchronized|native|default)\s+)*(?:<[^>]*>\s+)?[\w<>\[\],.?]+\s+(\w+)\s*\([^;]*$`)},
+	},
+	"kotlin": {
+		{SymbolType, regexp.MustCompile(`^\s*(?:(?:public|internal|private|protected|open|abstract|sealed|data|enum|inner|annotation|value)\s+)*(?:class|interface|object|typealias)\s+(\w+)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:(?:public|internal|private|protected|open|override|abstract|suspend|inline|operator)\s+)*fun\s+(?:<[^>]*>\s*)?(?:[\w.]+\.)?(\w+)`)},
+		{SymbolFunc, regexp.MustCompile(`^(?:(?:public|internal|private|suspend|inline|operator)\s+)*fun\s+(?:<[^>]*>\s*)?(?:[\w.]+\.)?(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*(?:(?:public|internal|private|protected)\s+)?const\s+val\s+(\w+)`)},
+	},
+	"c#": {
+		{SymbolType, regexp.MustCompile(`^\s*(?:(?:public|protected|private|internal|static|sealed|abstract|partial|readonly|ref)\s+)*(?:class|interface|struct|enum|record|delegate\s+\S+)\s+(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*(?:(?:public|protected|private|internal|static|new)\s+)*const\s+\S+\s+(\w+)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:(?:public|protected|private|internal|static|virtual|override|abstract|async|sealed|extern|unsafe|new)\s+)+[\w<>\[\],.?]+\s+(\w+)\s*(?:<[^>]*>)?\s*\([^;]*$`)},
+	},
+	"scala": {
+		{SymbolType, regexp.MustCompile(`^\s*(?:(?:private|protected|final|sealed|abstract|implicit|case)\s+)*(?:class|trait|object|type|enum)\s+(\w+)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:(?:private|protected|override|final|implicit)\s+)*def\s+(\w+)`)},
+		{SymbolFunc, regexp.MustCompile(`^def\s+(\w+)`)},
+	},
+	"swift": {
+		{SymbolType, regexp.MustCompile(`^\s*(?:(?:public|private|fileprivate|internal|open|final)\s+)*(?:class|struct|enum|protocol|actor|typealias|extension)\s+(\w+)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:(?:public|private|fileprivate|internal|open|final|override|static|class|mutating)\s+)*func\s+(\w+)`)},
+		{SymbolFunc, regexp.MustCompile(`^(?:(?:public|private|fileprivate|internal)\s+)*func\s+(\w+)`)},
+	},
+	"ruby": {
+		{SymbolFunc, regexp.MustCompile(`^def\s+(?:self\.)?(\w+[?!=]?)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+def\s+(?:self\.)?(\w+[?!=]?)`)},
+		{SymbolType, regexp.MustCompile(`^\s*(?:class|module)\s+(?:\w+::)*(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*([A-Z][A-Z0-9_]*)\s*=[^=]`)},
+	},
+	"php": {
+		{SymbolType, regexp.MustCompile(`^\s*(?:(?:abstract|final|readonly)\s+)*(?:class|interface|trait|enum)\s+(\w+)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s+(?:(?:public|protected|private|static|abstract|final)\s+)*function\s+&?(\w+)`)},
+		{SymbolFunc, regexp.MustCompile(`^function\s+&?(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*(?:(?:public|protected|private|final)\s+)*const\s+(\w+)`)},
+	},
+	"perl": {
+		{SymbolFunc, regexp.MustCompile(`^\s*sub\s+(\w+)`)},
+		{SymbolType, regexp.MustCompile(`^\s*package\s+(?:\w+::)*(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^\s*use\s+constant\s+(\w+)`)},
+	},
+	"shell": {
+		{SymbolFunc, regexp.MustCompile(`^\s*function\s+([\w.:-]+)`)},
+		{SymbolFunc, regexp.MustCompile(`^\s*([\w.:-]+)\s*\(\)`)},
+	},
+	"proto": {
+		{SymbolType, regexp.MustCompile(`^\s*(?:message|enum|service)\s+(\w+)`)},
+		{SymbolMethod, regexp.MustCompile(`^\s*rpc\s+(\w+)`)},
+	},
+	"makefile": {
+		{SymbolFunc, regexp.MustCompile(`^([\w.-]+)\s*:[^=]`)},
+		{SymbolVar, regexp.MustCompile(`^(\w+)\s*[:?+]?=`)},
+	},
+	"starlark": {
+		{SymbolFunc, regexp.MustCompile(`^def\s+(\w+)`)},
+		{SymbolConst, regexp.MustCompile(`^([A-Z][A-Z0-9_]*)\s*=[^=]`)},
+	},
+	"sql": {
+		{SymbolType, regexp.MustCompile(`(?i)^\s*create\s+(?:or\s+replace\s+)?(?:temporary\s+)?(?:table|view|type)\s+(?:if\s+not\s+exists\s+)?["\x60]?(\w+)`)},
+		{SymbolFunc, regexp.MustCompile(`(?i)^\s*create\s+(?:or\s+replace\s+)?(?:function|procedure)\s+["\x60]?(\w+)`)},
+	},
+}
+
+// ExtractSymbols returns the definitions found in the content of a file, in
+// order. Go files are parsed with go/parser, the files in other languages
+// are scanned line by line with heuristics, see lineSymbols. It returns nil
+// if the language of the file is unknown or has no heuristics.
+func ExtractSymbols(p, content string) []Symbol {
+	lang := DetectLanguage(p, content)
+	if lang == "go" {
+		if symbols, ok := goSymbols(content); ok {
+			return symbols
+		}
+		// fall back to the heuristics for the files that don't parse
+	}
+	if _, ok := symbolPatterns[lang]; !ok {
+		return nil
+	}
+	var symbols []Symbol
+	for idx, line := range strings.Split(content, "\n") {
+		for _, sym := range lineSymbols(lang, line) {
+			sym.Line = idx + 1
+			symbols = append(symbols, sym)
+		}
+	}
+	return symbols
+}
+
+// goSymbols returns the top-level definitions of a Go file: functions,
+// methods, types, constants and variables. It returns false if the file
+// cannot be parsed.
+func goSymbols(content string) ([]Symbol, bool) {
+	fset := gotoken.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", content, goparser.SkipObjectResolution)
+	if err != nil {
+		return nil, false
+	}
+	var symbols []Symbol
+	add := func(ident *goast.Ident, kind SymbolKind) {
+		if ident == nil || ident.Name == "_" {
+			return
+		}
+		pos := fset.Position(ident.Pos())
+		symbols = append(symbols, Symbol{Name: ident.Name, Kind: kind, Line: pos.Line, Column: pos.Column})
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *goast.FuncDecl:
+			if d.Recv != nil {
+				add(d.Name, SymbolMethod)
+			} else {
+				add(d.Name, SymbolFunc)
+			}
+		case *goast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *goast.TypeSpec:
+					add(s.Name, SymbolType)
+				case *goast.ValueSpec:
+					kind := SymbolVar
+					if d.Tok == gotoken.CONST {
+						kind = SymbolConst
+					}
+					for _, name := range s.Names {
+						add(name, kind)
+					}
+				}
+			}
+		}
+	}
+	return symbols, true
+}
+
+// symbolKeywords are the keywords that the heuristics can mistake for the
+// name of a function, e.g. in "} else if (x) {".
+var symbolKeywords = map[string]struct{}{
+	"if": {}, "for": {}, "while": {}, "switch": {}, "catch": {}, "return": {},
+	"else": {}, "new": {}, "sizeof": {}, "do": {}, "case": {},
+}
+
+// lineSymbols returns the definitions found on a single line with the
+// heuristics of the language, without the line number. The line may be a
+// fragment of a file, e.g. the line of a search result.
+func lineSymbols(lang, line string) []Symbol {
+	for _, sp := range symbolPatterns[lang] {
+		m := sp.re.FindStringSubmatchIndex(line)
+		if m == nil || m[2] < 0 {
+			continue
+		}
+		if _, ok := symbolKeywords[line[m[2]:m[3]]]; ok {
+			return nil
+		}
+		return []Symbol{{Name: line[m[2]:m[3]], Kind: sp.kind, Column: m[2] + 1}}
+	}
+	return nil
+}
+
+// symbolMatcher returns a regexp that matches the names of the symbols to
+// search: the terms of the query must match the whole name.
+func symbolMatcher(q *Query, caps Capabilities, opts SearchOptions) (*regexp.Regexp, error) {
+	opts.WordRegexp = false
+	re, err := termsMatcher(q, caps, opts)
+	if err != nil {
+		return nil, err
+	}
+	return regexp.MustCompile("^(?:" + re.String() + ")$"), nil
+}
+
+// matchSymbols returns the definitions of the symbols whose name matches re
+// as results, with the symbol name highlighted and the context lines. Like
+// matchContent, only the fields describing the match are set.
+func matchSymbols(content string, symbols []Symbol, re *regexp.Regexp, opts SearchOptions) Results {
+	var matched []Symbol
+	for _, sym := range symbols {
+		if re.MatchString(sym.Name) {
+			matched = append(matched, sym)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Line < matched[j].Line })
+	lines := strings.Split(content, "\n")
+	var results Results
+	for _, sym := range matched {
+		if sym.Line < 1 || sym.Line > len(lines) {
+			continue
+		}
+		hl := Range{Start: sym.Column - 1, End: sym.Column - 1 + len(sym.Name)}
+		if n := len(results); n > 0 && results[n-1].Start.Line == sym.Line {
+			// several symbols defined on the same line
+			results[n-1].addHighlight(hl)
+			continue
+		}
+		idx := sym.Line - 1
+		results = append(results, Result{
+			Lines: lines[idx : idx+1],
+			Start: Position{Line: sym.Line, Column: hl.Start + 1},
+			End:   Position{Line: sym.Line, Column: hl.End + 1},
+			Context: ResultContext{
+				Before: lines[max(0, idx-opts.LinesBefore):idx],
+				After:  lines[idx+1 : min(len(lines), idx+1+opts.LinesAfter)],
+			},
+			Highlights: []Range{hl},
+			SymbolKind: sym.Kind,
+		})
+	}
+	return results
+}